@@ -3,6 +3,8 @@ set -euxo pipefail
 mkdir -p "$(pwd)/functions"
 cd src
 GOBIN=$(pwd)/../functions go install ./...
+# the same program as the scheduled function retrying the geo index outbox
+go build -tags outboxfunction -o ../functions/processGeoIndexOutbox .
 cd ..
 chmod +x "$(pwd)"/functions/*
 go env
@@ -6,3 +6,21 @@ type address struct {
 	ZipCode string `bson:"zipCode,omitempty" json:"zipCode,omitempty"`
 	Country string `bson:"country,omitempty" json:"country,omitempty"`
 }
+
+// patchAddress returns the address with the non-empty fields of changes
+// applied, as PATCH merges them.
+func patchAddress(a address, changes address) address {
+	if len(changes.Street) > 0 {
+		a.Street = changes.Street
+	}
+	if len(changes.City) > 0 {
+		a.City = changes.City
+	}
+	if len(changes.ZipCode) > 0 {
+		a.ZipCode = changes.ZipCode
+	}
+	if len(changes.Country) > 0 {
+		a.Country = changes.Country
+	}
+	return a
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Error codes of apiError. Clients branch on these, so they must not change.
+const (
+	errorCodeInvalidParameter = "invalid_parameter"
+	errorCodeMissingParameter = "missing_parameter"
+	errorCodeInvalidJson      = "invalid_json"
+	errorCodeInvalidId        = "invalid_id"
+	errorCodeNotFound         = "not_found"
+	errorCodeMethodNotAllowed = "method_not_allowed"
+	errorCodeInternal         = "internal"
+	errorCodeUnauthorized     = "unauthorized"
+	errorCodeForbidden        = "forbidden"
+	errorCodeValidationFailed = "validation_failed"
+	errorCodeMissingField     = "missing_field"
+	errorCodeInvalidField     = "invalid_field"
+	// the farmer's status does not allow the requested status change
+	errorCodeInvalidStatusTransition = "invalid_status_transition"
+)
+
+// apiError is the body of every error response, wrapped in an "error" field:
+//
+//	{"error": {"code": "invalid_parameter", "message": "...", "field": "limit"}}
+type apiError struct {
+	// Code identifies the kind of error
+	Code string `json:"code"`
+	// Message describes the error to a developer, it is not localized
+	Message string `json:"message"`
+	// Field names the query parameter, path parameter or body field at fault
+	Field string `json:"field,omitempty"`
+	// Details lists the individual violations of a validation_failed error
+	Details []apiError `json:"details,omitempty"`
+}
+
+// writeError writes err as the JSON body of a response with the given status.
+func writeError(w http.ResponseWriter, status int, err apiError) {
+	b, marshalErr := json.Marshal(map[string]apiError{"error": err})
+	if marshalErr != nil {
+		log.Print(marshalErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeInternalError logs err and responds with a 500 that does not reveal
+// any details of err.
+func writeInternalError(w http.ResponseWriter, err error) {
+	log.Print(err)
+	writeError(w, http.StatusInternalServerError, apiError{Code: errorCodeInternal, Message: "Internal server error"})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, apiError{Code: errorCodeMethodNotAllowed, Message: "Method not allowed"})
+}
+
+func writeInvalidJson(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidJson, Message: "The request body is not valid JSON: " + err.Error()})
+}
+
+// writeValidationError responds with all violations at once, so that clients
+// can show them next to the respective fields.
+func writeValidationError(w http.ResponseWriter, err validationError) {
+	message := "1 field is invalid."
+	if len(err.violations) != 1 {
+		message = fmt.Sprintf("%d fields are invalid.", len(err.violations))
+	}
+	writeError(w, http.StatusUnprocessableEntity, apiError{Code: errorCodeValidationFailed, Message: message, Details: err.violations})
+}
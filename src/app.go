@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// app holds the backends the HTTP handlers work with. They are selected at
+// startup, so that the handlers can also run against in-memory backends.
+type app struct {
+	farmers  FarmerRepository
+	products ProductRepository
+	outbox   GeoIndexOutbox
+	geoIndex GeoIndex
+	geocoder Geocoder
+	taxonomy *taxonomy
+	// ping checks that the backends are reachable, nil if there is nothing
+	// to check
+	ping func(ctx context.Context) error
+	// signingKey verifies the tokens of authenticated requests
+	signingKey []byte
+}
+
+// newApp returns the app with the repositories configured by the REPOSITORY
+// environment variable (MongoDB is the default), the geo index configured by
+// GEO_INDEX and the geocoder dataset configured by GEOCODER_DATASET.
+// longRunning is set if the process serves HTTP itself, as with -port,
+// rather than one AWS Lambda invocation after another.
+func newApp(repository string, geoIndexName string, geocoderDataset string, longRunning bool) (*app, error) {
+	geoIndex, err := newGeoIndex(geoIndexName)
+	if err != nil {
+		return nil, err
+	}
+	geocoder, err := newGeocoder(geocoderDataset)
+	if err != nil {
+		return nil, err
+	}
+	taxonomy, err := newTaxonomy(taxonomyJson)
+	if err != nil {
+		return nil, err
+	}
+
+	switch repository {
+	case "", "mongo":
+		// the in-memory index starts out empty in every process, whereas the
+		// farmers persist. Lambda runs several short lived instances, each
+		// of which would have to load every farmer and would miss the
+		// writes of the others.
+		if memoryIndex, ok := geoIndex.(*memoryGeoIndex); ok {
+			if !longRunning {
+				return nil, fmt.Errorf("The memory geo index requires the memory repository or -port")
+			}
+			if err := fillGeoIndex(memoryIndex, mongoFarmerRepository{}); err != nil {
+				return nil, err
+			}
+		}
+		return &app{
+			farmers:  mongoFarmerRepository{},
+			products: mongoProductRepository{},
+			outbox:   mongoGeoIndexOutbox{},
+			geoIndex: geoIndex,
+			geocoder: geocoder,
+			taxonomy: taxonomy,
+			ping:     pingMongo,
+		}, nil
+	case "memory":
+		if _, ok := geoIndex.(*mongoGeoIndex); ok {
+			return nil, fmt.Errorf("The mongo geo index requires the mongo repository")
+		}
+		app := newMemoryApp(geoIndex)
+		app.geocoder = geocoder
+		app.taxonomy = taxonomy
+		return app, nil
+	default:
+		return nil, fmt.Errorf("Unknown repository: %s", repository)
+	}
+}
+
+// fillGeoIndex inserts the location of every farmer that belongs in the geo
+// index.
+func fillGeoIndex(index GeoIndex, farmers FarmerRepository) error {
+	locations, err := farmers.Locations()
+	if err != nil {
+		return fmt.Errorf("Could not fill the geo index: %w", err)
+	}
+	for id, location := range locations {
+		if err := index.Insert(id, location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slices"
+)
+
+// Requests are authenticated with JSON Web Tokens signed with HMAC-SHA256
+// (HS256) using the key in the AUTH_SIGNING_KEY environment variable, so they
+// can be verified without contacting any other service. Tokens are sent as
+// "Authorization: Bearer <token>". Reading is open to everyone; writing
+// requires the farmer role for the farmer's own document and products, or
+// the admin role for everything.
+
+const (
+	roleShopper = "shopper"
+	roleFarmer  = "farmer"
+	roleAdmin   = "admin"
+)
+
+var validRoles = []string{roleShopper, roleFarmer, roleAdmin}
+
+// signing keys shorter than this are rejected, HS256 needs 256 bits
+const minSigningKeyLength = 32
+
+// tolerated clock difference between the issuer and this server
+const tokenLeeway = time.Minute
+
+// tokenClaims are the claims of a token. Subject identifies the user; it is
+// what farmers are owned by.
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	Role      string `json:"role"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+}
+
+var errInvalidToken = errors.New("Invalid token")
+
+func checkSigningKey(key []byte) error {
+	if len(key) < minSigningKeyLength {
+		return fmt.Errorf("The signing key must be at least %d bytes long", minSigningKeyLength)
+	}
+	return nil
+}
+
+func signToken(data string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueToken returns a token for the subject with the role, valid for ttl.
+func issueToken(key []byte, subject string, role string, ttl time.Duration) (string, error) {
+	if err := checkSigningKey(key); err != nil {
+		return "", err
+	}
+	if len(subject) <= 0 {
+		return "", fmt.Errorf("The subject must not be empty")
+	}
+	if !slices.Contains(validRoles, role) {
+		return "", fmt.Errorf("Unknown role: %s", role)
+	}
+	now := time.Now()
+	header, err := json.Marshal(tokenHeader{Algorithm: "HS256", Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(tokenClaims{Subject: subject, Role: role, IssuedAt: now.Unix(), ExpiresAt: now.Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return data + "." + signToken(data, key), nil
+}
+
+// verifyToken checks the signature and expiry of the token and returns its
+// claims. Any problem results in errInvalidToken, wrapped with the reason.
+func verifyToken(key []byte, token string, now time.Time) (tokenClaims, error) {
+	if err := checkSigningKey(key); err != nil {
+		return tokenClaims{}, fmt.Errorf("%w: %s", errInvalidToken, err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, fmt.Errorf("%w: expected 3 parts, got %d", errInvalidToken, len(parts))
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("%w: %s", errInvalidToken, err)
+	}
+	var header tokenHeader
+	if err := json.Unmarshal(b, &header); err != nil {
+		return tokenClaims{}, fmt.Errorf("%w: %s", errInvalidToken, err)
+	}
+	// never let the token choose the algorithm, e.g. "none"
+	if header.Algorithm != "HS256" {
+		return tokenClaims{}, fmt.Errorf("%w: unsupported algorithm %s", errInvalidToken, header.Algorithm)
+	}
+	signature := signToken(parts[0]+"."+parts[1], key)
+	if !hmac.Equal([]byte(signature), []byte(parts[2])) {
+		return tokenClaims{}, fmt.Errorf("%w: bad signature", errInvalidToken)
+	}
+
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("%w: %s", errInvalidToken, err)
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return tokenClaims{}, fmt.Errorf("%w: %s", errInvalidToken, err)
+	}
+	if claims.ExpiresAt <= 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(tokenLeeway)) {
+		return tokenClaims{}, fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if len(claims.Subject) <= 0 || !slices.Contains(validRoles, claims.Role) {
+		return tokenClaims{}, fmt.Errorf("%w: missing subject or unknown role", errInvalidToken)
+	}
+	return claims, nil
+}
+
+type claimsContextKey struct{}
+
+// claimsFrom returns the claims of the authenticated request, if any.
+func claimsFrom(ctx context.Context) (tokenClaims, bool) {
+	claims, ok := ctx.Value(claimsContextKey{}).(tokenClaims)
+	return claims, ok
+}
+
+func isAdmin(r *http.Request) bool {
+	claims, ok := claimsFrom(r.Context())
+	return ok && claims.Role == roleAdmin
+}
+
+// isOwnerOrAdmin reports whether the request is made by an admin or by the
+// owner of the farmer.
+func isOwnerOrAdmin(r *http.Request, farmer farmer) bool {
+	if isAdmin(r) {
+		return true
+	}
+	claims, ok := claimsFrom(r.Context())
+	return ok && len(farmer.OwnerID) > 0 && farmer.OwnerID == claims.Subject
+}
+
+// isVisibleTo reports whether the farmer and their products may be read by
+// the request. Farmers that are not verified are only visible to their owner
+// and admins.
+func isVisibleTo(r *http.Request, farmer farmer) bool {
+	return farmer.isVerified() || isOwnerOrAdmin(r, farmer)
+}
+
+func writeUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="shopgreen"`)
+	writeError(w, http.StatusUnauthorized, apiError{Code: errorCodeUnauthorized, Message: message})
+}
+
+func writeForbidden(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusForbidden, apiError{Code: errorCodeForbidden, Message: message})
+}
+
+// isSafeMethod reports whether the method only reads.
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// authenticate is a middleware that verifies the bearer token of requests
+// carrying one and stores its claims in the request context. Requests
+// without a token pass on anonymously.
+func (app *app) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if len(authorization) <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if token == authorization {
+			writeUnauthorized(w, "The Authorization header must be a bearer token.")
+			return
+		}
+		claims, err := verifyToken(app.signingKey, token, time.Now())
+		if err != nil {
+			writeUnauthorized(w, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims)))
+	})
+}
+
+// requireRole lets requests that change something through only if they are
+// authenticated with one of the roles.
+func requireRole(roles []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) {
+			next(w, r)
+			return
+		}
+		claims, ok := claimsFrom(r.Context())
+		if !ok {
+			writeUnauthorized(w, "Authentication required.")
+			return
+		}
+		if !slices.Contains(roles, claims.Role) {
+			writeForbidden(w, "The role '"+claims.Role+"' may not do this.")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ownerLookup returns the owner of the farmer a request is about, or
+// errFarmerNotFound or errProductNotFound if there is none. Malformed ids are
+// reported as not found too, the handler rejects them anyway.
+type ownerLookup func(app *app, r *http.Request) (string, error)
+
+func farmerOwner(app *app, r *http.Request) (string, error) {
+	farmerObjectId, err := fromJsonFarmerId(mux.Vars(r)["id"])
+	if err != nil {
+		return "", errFarmerNotFound
+	}
+	farmer, err := app.farmers.Get(farmerObjectId)
+	if err != nil {
+		return "", err
+	}
+	return farmer.OwnerID, nil
+}
+
+func productOwner(app *app, r *http.Request) (string, error) {
+	productObjectId, err := fromJsonProductId(mux.Vars(r)["id"])
+	if err != nil {
+		return "", errProductNotFound
+	}
+	product, err := app.products.Get(productObjectId)
+	if err != nil {
+		return "", err
+	}
+	farmer, err := app.farmers.Get(product.MongoDbFarmerID)
+	if err != nil {
+		return "", err
+	}
+	return farmer.OwnerID, nil
+}
+
+// requireOwner lets requests that change something through only if they are
+// made by an admin or by the farmer owning the addressed farmer. Requests for
+// farmers or products that do not exist are passed on, so that the handler
+// reports them as usual.
+func (app *app) requireOwner(lookup ownerLookup, next http.HandlerFunc) http.HandlerFunc {
+	return requireRole([]string{roleFarmer, roleAdmin}, func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) || isAdmin(r) {
+			next(w, r)
+			return
+		}
+		owner, err := lookup(app, r)
+		if err == errFarmerNotFound || err == errProductNotFound {
+			next(w, r)
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		claims, _ := claimsFrom(r.Context())
+		if len(owner) <= 0 || owner != claims.Subject {
+			writeForbidden(w, "Only the owner of the farmer may do this.")
+			return
+		}
+		next(w, r)
+	})
+}
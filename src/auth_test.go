@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// craftToken signs a token with the given header and claims, which need not
+// be valid.
+func craftToken(t *testing.T, key []byte, header interface{}, claims interface{}) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return data + "." + signToken(data, key)
+}
+
+func TestVerifyToken(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Unix(1700000000, 0)
+	hs256 := tokenHeader{Algorithm: "HS256", Type: "JWT"}
+	valid := tokenClaims{Subject: "anna", Role: roleFarmer, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()}
+	expiredAt := func(expiresAt time.Time) tokenClaims {
+		claims := valid
+		claims.ExpiresAt = expiresAt.Unix()
+		return claims
+	}
+	validToken := craftToken(t, key, hs256, valid)
+	parts := strings.Split(validToken, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", validToken, true},
+		{"alg none", func() string {
+			token := craftToken(t, key, tokenHeader{Algorithm: "none", Type: "JWT"}, valid)
+			return token[:strings.LastIndex(token, ".")+1]
+		}(), false},
+		{"alg none with signature", craftToken(t, key, tokenHeader{Algorithm: "none"}, valid), false},
+		{"alg HS512", craftToken(t, key, tokenHeader{Algorithm: "HS512"}, valid), false},
+		{"wrong signature", craftToken(t, []byte("fedcba9876543210fedcba9876543210"), hs256, valid), false},
+		{"tampered claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","role":"admin","exp":1800000000}`)) + "." + parts[2], false},
+		{"missing signature", parts[0] + "." + parts[1], false},
+		{"expired", craftToken(t, key, hs256, expiredAt(now.Add(-time.Hour))), false},
+		{"expired within leeway", craftToken(t, key, hs256, expiredAt(now.Add(-tokenLeeway))), true},
+		{"expired beyond leeway", craftToken(t, key, hs256, expiredAt(now.Add(-tokenLeeway-time.Second))), false},
+		{"without expiry", craftToken(t, key, hs256, tokenClaims{Subject: "anna", Role: roleFarmer}), false},
+		{"malformed header base64", "not*base64." + parts[1] + "." + parts[2], false},
+		{"malformed claims base64", func() string {
+			data := parts[0] + ".not*base64"
+			return data + "." + signToken(data, key)
+		}(), false},
+		{"claims not JSON", func() string {
+			data := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte("anna"))
+			return data + "." + signToken(data, key)
+		}(), false},
+		{"missing sub", craftToken(t, key, hs256, tokenClaims{Role: roleFarmer, ExpiresAt: now.Add(time.Hour).Unix()}), false},
+		{"unknown role", craftToken(t, key, hs256, tokenClaims{Subject: "anna", Role: "root", ExpiresAt: now.Add(time.Hour).Unix()}), false},
+		{"empty", "", false},
+	}
+	for _, test := range tests {
+		claims, err := verifyToken(key, test.token, now)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: expected the token to be valid, got %s", test.name, err)
+			} else if claims.Subject != "anna" || claims.Role != roleFarmer {
+				t.Errorf("%s: expected the claims of anna, got %+v", test.name, claims)
+			}
+			continue
+		}
+		if !errors.Is(err, errInvalidToken) {
+			t.Errorf("%s: expected errInvalidToken, got %v", test.name, err)
+		}
+	}
+}
+
+func TestVerifyTokenRequiresSigningKey(t *testing.T) {
+	token, err := issueToken([]byte("0123456789abcdef0123456789abcdef"), "anna", roleFarmer, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyToken([]byte("short"), token, time.Now()); !errors.Is(err, errInvalidToken) {
+		t.Errorf("Expected a short key to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// cors is a middleware answering CORS preflight requests and allowing the
+// configured origins to read responses. An origin of "*" allows every
+// origin.
+type cors struct {
+	allowedOrigins []string
+}
+
+// newCors returns the CORS configuration for a comma separated list of
+// origins, as given by the CORS_ALLOWED_ORIGINS environment variable. No
+// origin is allowed if the list is empty.
+func newCors(origins string) cors {
+	allowedOrigins := make([]string, 0)
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if len(origin) > 0 {
+			allowedOrigins = append(allowedOrigins, origin)
+		}
+	}
+	return cors{allowedOrigins: allowedOrigins}
+}
+
+func (c cors) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if slices.Contains(c.allowedOrigins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if len(origin) > 0 && slices.Contains(c.allowedOrigins, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == "OPTIONS" && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
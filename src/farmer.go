@@ -1,18 +1,14 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"os"
+	"log"
+	"sort"
 	"strings"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/exp/maps"
 )
 
@@ -27,7 +23,26 @@ type farmer struct {
 	Location                                     geoLocation          `bson:"location,omitempty" json:"location,omitempty"`
 	Features                                     []string             `bson:"features,omitempty" json:"features,omitempty"`
 	OpeningHoursByDayOfWeekSecondsFromStartOfDay map[string][][]int32 `bson:"openingHoursByDayOfWeek_secondsFromStartOfDay,omitempty" json:"openingHoursByDayOfWeek_secondsFromStartOfDay,omitempty"`
+	TimeZone                                     string               `bson:"timeZone,omitempty" json:"timeZone,omitempty"`
+	OwnerID                                      string               `bson:"ownerId,omitempty" json:"ownerId,omitempty"`
+	Status                                       string               `bson:"status,omitempty" json:"status,omitempty"`
+	StatusHistory                                []farmerStatusChange `bson:"statusHistory,omitempty" json:"statusHistory,omitempty"`
+	Geo                                          *geoJsonPoint        `bson:"geo,omitempty" json:"-"`
 	Distance_km                                  float64              `bson:"-" json:"distance_km,omitempty"`
+	Score                                        float64              `bson:"-" json:"score,omitempty"`
+	MatchedGroceryTypes                          []groceryTypeMatch   `bson:"-" json:"matchedGroceryTypes,omitempty"`
+	IsOpenNow                                    bool                 `bson:"-" json:"isOpenNow"`
+	NextOpensAt                                  *time.Time           `bson:"-" json:"nextOpensAt,omitempty"`
+	NextClosesAt                                 *time.Time           `bson:"-" json:"nextClosesAt,omitempty"`
+}
+
+// withoutPrivateFields returns the farmer as shown to everyone but its owner
+// and admins, without who owns it and the history of its status, which
+// names the admins involved and their reasons.
+func (farmer farmer) withoutPrivateFields() farmer {
+	farmer.OwnerID = ""
+	farmer.StatusHistory = nil
+	return farmer
 }
 
 func toJsonFarmerId(id primitive.ObjectID) string {
@@ -42,243 +57,367 @@ func fromJsonFarmerId(id string) (primitive.ObjectID, error) {
 	return primitive.ObjectIDFromHex(id[2:])
 }
 
-func getFramerIdsAndDistancesNearByFromKinetica(point geoLocation, maxDistance_km float64) (map[string]float64, error) {
-	url := os.Getenv("KINETICA_BASE_URL") + "/execute/sql"
-	method := "GET"
+// withinDistance returns the farmers within maxDistance_km of point, with
+// their distance set, capped at the maxRadiusResults nearest like a geo index
+// query.
+func withinDistance(farmers []farmer, point geoLocation, maxDistance_km float64) []farmer {
+	results := make([]farmer, 0, len(farmers))
+	for _, farmer := range farmers {
+		distance_m := haversineDistance_m(point, farmer.Location)
+		if distance_m < maxDistance_km*1000 {
+			farmer.Distance_km = distance_m / 1000
+			results = append(results, farmer)
+		}
+	}
+	if len(results) > maxRadiusResults {
+		sortFarmers(results, farmerSortDistance)
+		results = results[:maxRadiusResults]
+	}
+	return results
+}
 
-	query := fmt.Sprintf(`{
-		"statement": "SELECT id, GEODIST(farmers.longitude, farmers.latitude, %.14f, %.14f) AS distance_m FROM farmers WHERE GEODIST(farmers.longitude, farmers.latitude, %.14f, %.14f) < %.14f;",
-		"offset": 0,
-		"limit": 100,
-		"encoding": "json"
-	}`, point.Longitude, point.Latitude, point.Longitude, point.Latitude, maxDistance_km*1000)
-	payload := strings.NewReader(query)
+const (
+	farmerSortRelevance = "relevance"
+	farmerSortDistance  = "distance"
+	farmerSortRating    = "rating"
+	farmerSortName      = "name"
+)
 
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, payload)
+func isValidFarmerSort(sortBy string) bool {
+	return sortBy == farmerSortRelevance || sortBy == farmerSortDistance || sortBy == farmerSortRating || sortBy == farmerSortName
+}
 
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", os.Getenv("KINETICA_AUTHORIZATION"))
+// sortFarmers orders farmers by decreasing score, increasing distance,
+// decreasing rating or name. Ties are broken by id so that pages of a result
+// are stable.
+func sortFarmers(farmers []farmer, sortBy string) {
+	sort.SliceStable(farmers, func(i, j int) bool {
+		a, b := farmers[i], farmers[j]
+		switch sortBy {
+		case farmerSortRelevance:
+			if a.Score != b.Score {
+				return a.Score > b.Score
+			}
+			if a.Distance_km != b.Distance_km {
+				return a.Distance_km < b.Distance_km
+			}
+		case farmerSortRating:
+			if a.Rating != b.Rating {
+				return a.Rating > b.Rating
+			}
+		case farmerSortName:
+			if nameA, nameB := strings.ToLower(a.Name), strings.ToLower(b.Name); nameA != nameB {
+				return nameA < nameB
+			}
+		default:
+			if a.Distance_km != b.Distance_km {
+				return a.Distance_km < b.Distance_km
+			}
+		}
+		return a.ID < b.ID
+	})
+}
 
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
+func (app *app) getFarmersNearBy(
+	point geoLocation,
+	maxDistance_km float64,
+	text string,
+	tags farmerFilter,
+	openingHours *timeInterval,
+	sortBy string,
+) ([]farmer, error) {
+	var farmers []farmer
+	if searcher, ok := app.geoIndex.(farmerGeoSearcher); ok {
+		var err error
+		farmers, err = searcher.findFarmersNearBy(point, maxDistance_km, tags)
+		if err != nil {
+			return nil, err
+		}
+		for i, farmer := range farmers {
+			farmers[i].ID = toJsonFarmerId(farmer.MongoDbID)
+		}
+	} else {
+		idsAndDistances, err := app.geoIndex.QueryRadius(point, maxDistance_km)
+		if errors.Is(err, errGeoIndexUnavailable) {
+			// degrade to scanning the farmers rather than failing the search
+			log.Printf("Searching without the geo index: %s", err)
+			farmers, err = app.farmers.FindNearBy(point, maxDistance_km, tags)
+			if err != nil {
+				return nil, err
+			}
+			for i, farmer := range farmers {
+				farmers[i].ID = toJsonFarmerId(farmer.MongoDbID)
+			}
+		} else {
+			if err != nil {
+				return nil, err
+			}
+			farmers, err = app.farmers.FindByIDs(maps.Keys(idsAndDistances), tags)
+			if err != nil {
+				return nil, err
+			}
+			for i, farmer := range farmers {
+				farmers[i].ID = toJsonFarmerId(farmer.MongoDbID)
+				farmers[i].Distance_km = idsAndDistances[farmer.MongoDbID.Hex()] / 1000
+			}
+		}
 	}
-	defer res.Body.Close()
-
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+	if openingHours != nil {
+		farmers = filterFarmersByOpeningHours(farmers, *openingHours)
 	}
-	resp, err := parseBodyAsKineticaResponse(body)
-	if err != nil {
-		return nil, err
+	if len(searchTerms(text)) > 0 {
+		var err error
+		farmers, err = app.matchFarmersByText(farmers, text, maxDistance_km)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// tell shoppers filtering by a category which of its subcategories a
+	// farmer offers
+	requested := append(append([]string{}, tags["groceryTypes"].All...), tags["groceryTypes"].Any...)
+	if len(requested) > 0 {
+		for i := range farmers {
+			farmers[i].MatchedGroceryTypes = app.taxonomy.matchGroceryTypes(requested, farmers[i].GroceryTypes)
+		}
+	}
+	now := time.Now()
+	for i := range farmers {
+		setOpeningStatus(&farmers[i], now)
 	}
-	if resp.Status != "OK" {
-		return nil, fmt.Errorf("Kinetica response status is %s (expected OK): %s", resp.Status, resp.Message)
+	sortFarmers(farmers, sortBy)
+	return farmers, nil
+}
+
+// weights of the fields of farmers and their products in text search
+const (
+	farmerNameWeight          = 3
+	productNameInFarmerWeight = 2
+	farmerTagWeight           = 1
+)
+
+// contributions to the score of a farmer matching a text search, which sum
+// up to 1
+const (
+	textRelevanceWeight     = 0.6
+	distanceRelevanceWeight = 0.25
+	ratingRelevanceWeight   = 0.15
+)
+
+// matchFarmersByText returns the farmers whose name, features, grocery types
+// or products match every term of text, tolerating typos and diacritics. Their
+// score blends how well and where they match with how close and how well
+// rated they are.
+func (app *app) matchFarmersByText(farmers []farmer, text string, maxDistance_km float64) ([]farmer, error) {
+	if len(farmers) <= 0 {
+		return farmers, nil
 	}
-	if resp.DataType != "execute_sql_response" {
-		return nil, fmt.Errorf("Kinetica response data_type is %s (expected execute_sql_response): %s", resp.DataType, resp.Message)
+	index := newTextIndex()
+	farmerIds := make([]primitive.ObjectID, len(farmers))
+	documents := make(map[primitive.ObjectID]int, len(farmers))
+	for i, farmer := range farmers {
+		farmerIds[i] = farmer.MongoDbID
+		documents[farmer.MongoDbID] = i
+		index.add(i, farmer.Name, farmerNameWeight)
+		for _, tag := range append(append([]string{}, farmer.Features...), farmer.GroceryTypes...) {
+			index.add(i, tag, farmerTagWeight)
+		}
 	}
-	sqlResp, err := parseExecuteSqlResponse(resp.DataStr)
+	products, err := app.products.Search(farmerIds, productSearch{})
 	if err != nil {
 		return nil, err
 	}
-	rows, err := parseJsonEncodedResponseAsListOfMaps(sqlResp.JsonEncodedResponse)
-	if err != nil {
-		return nil, err
+	for _, product := range products {
+		document := documents[product.MongoDbFarmerID]
+		index.add(document, product.Name, productNameInFarmerWeight)
+		index.add(document, product.Description, farmerTagWeight)
 	}
 
-	idsAndDistances := make(map[string]float64)
-	for _, row := range rows {
-		idsAndDistances[row["id"].(string)] = row["distance_m"].(float64)
+	// the best possible match is every term in the name
+	bestScore := float64(len(searchTerms(text)) * farmerNameWeight)
+	scores := index.search(text)
+	results := make([]farmer, 0, len(scores))
+	for i, farmer := range farmers {
+		score, ok := scores[i]
+		if !ok {
+			continue
+		}
+		closeness := 0.0
+		if maxDistance_km > 0 && farmer.Distance_km < maxDistance_km {
+			closeness = 1 - farmer.Distance_km/maxDistance_km
+		}
+		farmer.Score = textRelevanceWeight*score/bestScore +
+			distanceRelevanceWeight*closeness +
+			ratingRelevanceWeight*float64(farmer.Rating)/maxRating
+		results = append(results, farmer)
 	}
-	return idsAndDistances, nil
+	return results, nil
 }
 
-func getFarmersByFiltersFromMongo(
-	ids []string,
-	groceryTypes []string,
-	features []string,
-) ([]farmer, error) {
-	client, err := mongo.NewClient(options.Client().ApplyURI(os.Getenv("MONGODB_CONNECTION_STRING")))
-	if err != nil {
-		return nil, err
+// geocode returns the location of the address, reporting an address that
+// cannot be found as an invalid address field.
+func (app *app) geocode(address address) (geoLocation, error) {
+	location, err := app.geocoder.Geocode(address)
+	if errors.Is(err, errAddressNotFound) {
+		return location, validationError{violations: []apiError{{Code: errorCodeInvalidField, Message: err.Error() + ". Give the location instead.", Field: "address"}}}
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	err = client.Connect(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer client.Disconnect(ctx)
-
-	coll := client.Database("shopGreenDB").Collection("farmers")
+	return location, err
+}
 
-	// convert ids to bson object ids
-	objectIds := make([]primitive.ObjectID, 0)
-	for _, id := range ids {
-		objectId, err := primitive.ObjectIDFromHex(id)
+// addFarmer stores a new farmer, who stays pending and therefore invisible to
+// shoppers until an admin approves them. Without a location the farmer is
+// located by its address.
+func (app *app) addFarmer(farmer farmer, createdBy string) (farmer, error) {
+	if farmer.Location == (geoLocation{}) && farmer.Address != (address{}) {
+		location, err := app.geocode(farmer.Address)
 		if err != nil {
-			return nil, err
-		}
-		objectIds = append(objectIds, objectId)
-	}
-	// a filter for mongodb query that checks if the id is in the ids array and the groceryTypes array is a subset of the groceryTypes array in the document
-	var filter bson.D
-	if len(groceryTypes) <= 0 && len(features) <= 0 {
-		filter = bson.D{{"_id", bson.D{{"$in", objectIds}}}}
-	} else if len(groceryTypes) <= 0 && len(features) > 0 {
-		filter = bson.D{
-			{"$and",
-				bson.A{
-					bson.D{{"_id", bson.D{{"$in", objectIds}}}},
-					bson.D{{"features", bson.D{{"$all", features}}}},
-				}},
-		}
-	} else if len(groceryTypes) > 0 && len(features) <= 0 {
-		filter = bson.D{
-			{"$and",
-				bson.A{
-					bson.D{{"_id", bson.D{{"$in", objectIds}}}},
-					bson.D{{"groceryTypes", bson.D{{"$all", groceryTypes}}}},
-				}},
-		}
-	} else if len(groceryTypes) > 0 && len(features) > 0 {
-		filter = bson.D{
-			{"$and",
-				bson.A{
-					bson.D{{"_id", bson.D{{"$in", objectIds}}}},
-					bson.D{{"groceryTypes", bson.D{{"$all", groceryTypes}}}},
-					bson.D{{"features", bson.D{{"$all", features}}}},
-				}},
+			return farmer, err
 		}
+		farmer.Location = location
+	}
+	farmer.Features = app.taxonomy.normalizeFeatures(farmer.Features)
+	if err := validateFarmer(app.taxonomy, farmer, false); err != nil {
+		return farmer, err
 	}
-	// sort := bson.D{{"date_ordered", 1}}
-	opts := options.Find() //.SetSort(sort)
+	farmer.Status = farmerStatusPending
+	farmer.StatusHistory = []farmerStatusChange{{Status: farmerStatusPending, ChangedAt: time.Now().UTC(), ChangedBy: createdBy}}
+	farmer.MongoDbID = primitive.ObjectID{}
+	farmer.Distance_km = 0
+	farmer.GroceryTypes = make([]string, 0)
 
-	cursor, err := coll.Find(ctx, filter, opts)
+	farmer, err := app.farmers.Insert(farmer)
 	if err != nil {
-		return nil, err
+		return farmer, err
 	}
 
-	var results []farmer = make([]farmer, 0)
-	if err = cursor.All(ctx, &results); err != nil {
-		return nil, err
-	}
+	app.flushGeoIndexOutbox(farmer.MongoDbID)
 
-	return results, nil
+	farmer.ID = toJsonFarmerId(farmer.MongoDbID)
+
+	return farmer, nil
 }
 
-func getFarmersNearBy(
-	point geoLocation,
-	maxDistance_km float64,
-	groceryTypes []string,
-	features []string,
-	// openingHours time.Time,
-) ([]farmer, error) {
-	idsAndDistances, err := getFramerIdsAndDistancesNearByFromKinetica(point, maxDistance_km)
+var errFarmerNotFound = errors.New("Farmer not found")
+
+func (app *app) getFarmer(farmerId string) (farmer, error) {
+	farmerObjectId, err := fromJsonFarmerId(farmerId)
 	if err != nil {
-		return nil, err
+		return farmer{}, err
 	}
-	farmers, err := getFarmersByFiltersFromMongo(maps.Keys(idsAndDistances), groceryTypes, features)
+	farmer, err := app.farmers.Get(farmerObjectId)
 	if err != nil {
-		return nil, err
-	}
-	for i, farmer := range farmers {
-		farmers[i].ID = toJsonFarmerId(farmer.MongoDbID)
-		farmers[i].Distance_km = idsAndDistances[farmer.MongoDbID.Hex()] / 1000
+		return farmer, err
 	}
-	return farmers, nil
+	farmer.ID = toJsonFarmerId(farmer.MongoDbID)
+	setOpeningStatus(&farmer, time.Now())
+	return farmer, nil
 }
 
-func addFarmerToKinetica(farmer farmer) error {
-	url := os.Getenv("KINETICA_BASE_URL") + "/insert/records/json?table_name=farmers"
-	method := "POST"
-
-	sFarmer := fmt.Sprintf(`{
-		"id": "%s",
-		"longitude": %.14f,
-		"latitude": %.14f
-	}`, farmer.MongoDbID.Hex(), farmer.Location.Longitude, farmer.Location.Latitude)
-	payload := strings.NewReader(sFarmer)
-
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, payload)
-
+// updateFarmer applies the non-empty fields of changes to the farmer and
+// moves its geo point if the location changed. If the address changes
+// without a location, the farmer is located by the new address.
+func (app *app) updateFarmer(farmerId string, changes farmer) (farmer, error) {
+	farmerObjectId, err := fromJsonFarmerId(farmerId)
 	if err != nil {
-		return err
+		return farmer{}, err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", os.Getenv("KINETICA_AUTHORIZATION"))
-
-	res, err := client.Do(req)
-	if err != nil {
-		return err
+	changes.Features = app.taxonomy.normalizeFeatures(changes.Features)
+	if err := validateFarmer(app.taxonomy, changes, true); err != nil {
+		return farmer{}, err
 	}
-	defer res.Body.Close()
-
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return err
+	if changes.Location == (geoLocation{}) && changes.Address != (address{}) {
+		existing, err := app.farmers.Get(farmerObjectId)
+		if err != nil {
+			return farmer{}, err
+		}
+		// the address is merged field by field like the repository does
+		patched := patchAddress(existing.Address, changes.Address)
+		if patched != existing.Address {
+			changes.Location, err = app.geocode(patched)
+			if err != nil {
+				return farmer{}, err
+			}
+		}
 	}
-	resp, err := parseBodyAsKineticaResponse(body)
+	// grocery types are derived from the products, distances from queries,
+	// and the status changes through changeFarmerStatus only
+	changes.MongoDbID = primitive.ObjectID{}
+	changes.Status = ""
+	changes.StatusHistory = nil
+	changes.GroceryTypes = nil
+	changes.Geo = nil
+	changes.Distance_km = 0
+
+	updated, err := app.farmers.Update(farmerObjectId, changes)
 	if err != nil {
-		return err
+		return farmer{}, err
 	}
-	if resp.Status != "OK" {
-		return fmt.Errorf("Kinetica response status is %s (expected OK): %s", resp.Status, resp.Message)
+	if changes.Location != (geoLocation{}) {
+		app.flushGeoIndexOutbox(farmerObjectId)
 	}
-	if resp.DataType != "insert_records_from_payload_response" {
-		return fmt.Errorf("Kinetica response data_type is %s (expected insert_records_from_payload_response): %s", resp.DataType, resp.Message)
-	}
-	return nil
+
+	updated.ID = toJsonFarmerId(updated.MongoDbID)
+	setOpeningStatus(&updated, time.Now())
+	return updated, nil
 }
 
-func addFarmerToMongo(farmer farmer) (farmer, error) {
-	// Connect to MongoDB
-	client, err := mongo.NewClient(options.Client().ApplyURI(os.Getenv("MONGODB_CONNECTION_STRING")))
+// replaceFarmer replaces all client editable fields of the farmer and moves
+// its geo point to the new location. The owner and rating are kept unless
+// the replacement sets them. Without a location the farmer keeps its
+// location if the address is unchanged and is located by the address
+// otherwise.
+func (app *app) replaceFarmer(farmerId string, replacement farmer) (farmer, error) {
+	existing, err := app.getFarmer(farmerId)
 	if err != nil {
-		return farmer, err
+		return farmer{}, err
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	err = client.Connect(ctx)
-	if err != nil {
-		return farmer, err
+	if replacement.Location == (geoLocation{}) && replacement.Address != (address{}) {
+		if replacement.Address == existing.Address {
+			replacement.Location = existing.Location
+		} else {
+			replacement.Location, err = app.geocode(replacement.Address)
+			if err != nil {
+				return farmer{}, err
+			}
+		}
+	}
+	replacement.Features = app.taxonomy.normalizeFeatures(replacement.Features)
+	if err := validateFarmer(app.taxonomy, replacement, false); err != nil {
+		return farmer{}, err
 	}
-	defer client.Disconnect(ctx)
+	replacement.MongoDbID = existing.MongoDbID
+	replacement.Status = existing.Status
+	replacement.StatusHistory = existing.StatusHistory
+	if len(replacement.OwnerID) <= 0 {
+		replacement.OwnerID = existing.OwnerID
+	}
+	if replacement.Rating == 0 {
+		replacement.Rating = existing.Rating
+	}
+	replacement.GroceryTypes = existing.GroceryTypes
+	replacement.Geo = existing.Geo
+	replacement.Distance_km = 0
 
-	// Insert farmer
-	coll := client.Database("shopGreenDB").Collection("farmers")
-	result, err := coll.InsertMany(ctx, []interface{}{farmer})
+	err = app.farmers.Replace(replacement)
 	if err != nil {
-		return farmer, err
-	}
-	if len(result.InsertedIDs) != 1 {
-		return farmer, fmt.Errorf("Expected 1 inserted id, got %d", len(result.InsertedIDs))
+		return farmer{}, err
 	}
-	farmer.MongoDbID = result.InsertedIDs[0].(primitive.ObjectID)
-	return farmer, nil
-}
+	app.flushGeoIndexOutbox(replacement.MongoDbID)
 
-func addFarmer(farmer farmer) (farmer, error) {
-	farmer.MongoDbID = primitive.ObjectID{}
-	farmer.Distance_km = 0
-	farmer.GroceryTypes = make([]string, 0)
+	replacement.ID = toJsonFarmerId(replacement.MongoDbID)
+	setOpeningStatus(&replacement, time.Now())
+	return replacement, nil
+}
 
-	farmer, err := addFarmerToMongo(farmer)
+// deleteFarmer removes the farmer, their products and their geo point.
+func (app *app) deleteFarmer(farmerId string) error {
+	farmerObjectId, err := fromJsonFarmerId(farmerId)
 	if err != nil {
-		return farmer, err
+		return err
 	}
-
-	err = addFarmerToKinetica(farmer)
+	err = app.farmers.Delete(farmerObjectId)
 	if err != nil {
-		return farmer, err
+		return err
 	}
-
-	farmer.ID = toJsonFarmerId(farmer.MongoDbID)
-
-	return farmer, nil
+	app.flushGeoIndexOutbox(farmerObjectId)
+	return nil
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/exp/slices"
+)
+
+// tagCondition restricts the tags of one field of a farmer, e.g. its
+// features. A farmer matches if it has all of All, at least one of Any unless
+// Any is empty, and none of None. A requested tag may stand for several tags,
+// e.g. a grocery type for itself and its subcategories, in which case having
+// one of them counts as having the requested tag.
+type tagCondition struct {
+	All  []string
+	Any  []string
+	None []string
+	// expand returns the tags a requested tag stands for, nil if just itself
+	expand func(tag string) []string
+}
+
+// tags returns the tags a requested tag stands for.
+func (condition tagCondition) tags(tag string) []string {
+	if condition.expand == nil {
+		return []string{tag}
+	}
+	return condition.expand(tag)
+}
+
+// tagsOf returns the tags the requested tags stand for together.
+func (condition tagCondition) tagsOf(requested []string) []string {
+	tags := make([]string, 0, len(requested))
+	for _, tag := range requested {
+		for _, expanded := range condition.tags(tag) {
+			if !slices.Contains(tags, expanded) {
+				tags = append(tags, expanded)
+			}
+		}
+	}
+	return tags
+}
+
+// hasAny reports whether values contains one of tags.
+func hasAny(values []string, tags []string) bool {
+	return slices.ContainsFunc(tags, func(tag string) bool { return slices.Contains(values, tag) })
+}
+
+func (condition tagCondition) isEmpty() bool {
+	return len(condition.All) <= 0 && len(condition.Any) <= 0 && len(condition.None) <= 0
+}
+
+func (condition tagCondition) matches(values []string) bool {
+	for _, tag := range condition.All {
+		if !hasAny(values, condition.tags(tag)) {
+			return false
+		}
+	}
+	if len(condition.Any) > 0 && !hasAny(values, condition.tagsOf(condition.Any)) {
+		return false
+	}
+	return !hasAny(values, condition.tagsOf(condition.None))
+}
+
+// mongoConditions returns the MongoDB queries equivalent of matches for the
+// array field with the given name.
+func (condition tagCondition) mongoConditions(field string) bson.A {
+	conditions := bson.A{}
+	for _, tag := range condition.All {
+		conditions = append(conditions, bson.D{{field, bson.D{{"$in", condition.tags(tag)}}}})
+	}
+	if len(condition.Any) > 0 {
+		conditions = append(conditions, bson.D{{field, bson.D{{"$in", condition.tagsOf(condition.Any)}}}})
+	}
+	if len(condition.None) > 0 {
+		conditions = append(conditions, bson.D{{field, bson.D{{"$nin", condition.tagsOf(condition.None)}}}})
+	}
+	return conditions
+}
+
+// farmerTagField is a tag field of farmers that can be filtered by.
+type farmerTagField struct {
+	// Name is the name of the field in query parameters and in MongoDB
+	Name   string
+	Values func(farmer farmer) []string
+	// Expand returns the tags a requested tag stands for in the taxonomy
+	Expand func(taxonomy *taxonomy, tag string) []string
+}
+
+// farmerTagFields lists the fields farmerFilter supports. A new filterable
+// field only needs an entry here.
+var farmerTagFields = []farmerTagField{
+	{
+		Name:   "groceryTypes",
+		Values: func(farmer farmer) []string { return farmer.GroceryTypes },
+		Expand: func(taxonomy *taxonomy, tag string) []string { return taxonomy.expandGroceryType(tag) },
+	},
+	{
+		Name:   "features",
+		Values: func(farmer farmer) []string { return farmer.Features },
+		Expand: func(taxonomy *taxonomy, tag string) []string { return taxonomy.expandFeature(tag) },
+	},
+}
+
+// farmerFilter holds the conditions on the tags of farmers by field name. An
+// empty filter matches every farmer.
+type farmerFilter map[string]tagCondition
+
+// matches reports whether the farmer satisfies every condition.
+func (filter farmerFilter) matches(farmer farmer) bool {
+	for _, field := range farmerTagFields {
+		if !filter[field.Name].matches(field.Values(farmer)) {
+			return false
+		}
+	}
+	return true
+}
+
+// mongoQuery compiles the filter into a MongoDB query.
+func (filter farmerFilter) mongoQuery() bson.D {
+	conditions := bson.A{}
+	for _, field := range farmerTagFields {
+		conditions = append(conditions, filter[field.Name].mongoConditions(field.Name)...)
+	}
+	if len(conditions) <= 0 {
+		return bson.D{}
+	}
+	return bson.D{{"$and", conditions}}
+}
+
+// parseFarmerFilter reads the comma separated tags of the parameters
+// filter_<field> (all of them), filter_<field>_any and filter_<field>_none for
+// every tag field, e.g. filter_groceryTypes_any=vegetables,fruit. Tags are
+// expanded using the taxonomy.
+func parseFarmerFilter(query url.Values, taxonomy *taxonomy) farmerFilter {
+	filter := make(farmerFilter)
+	for _, field := range farmerTagFields {
+		expand := field.Expand
+		condition := tagCondition{
+			All:    splitTags(query.Get("filter_" + field.Name)),
+			Any:    splitTags(query.Get("filter_" + field.Name + "_any")),
+			None:   splitTags(query.Get("filter_" + field.Name + "_none")),
+			expand: func(tag string) []string { return expand(taxonomy, tag) },
+		}
+		if !condition.isEmpty() {
+			filter[field.Name] = condition
+		}
+	}
+	return filter
+}
+
+// splitTags splits a comma separated list, skipping empty entries.
+func splitTags(s string) []string {
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(s, ",") {
+		if len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTagConditionMatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition tagCondition
+		values    []string
+		want      bool
+	}{
+		{"empty", tagCondition{}, nil, true},
+		{"all", tagCondition{All: []string{"organic", "parking"}}, []string{"parking", "organic", "delivery"}, true},
+		{"all missing one", tagCondition{All: []string{"organic", "parking"}}, []string{"organic"}, false},
+		{"any", tagCondition{Any: []string{"organic", "parking"}}, []string{"parking"}, true},
+		{"any missing all", tagCondition{Any: []string{"organic", "parking"}}, []string{"delivery"}, false},
+		{"none", tagCondition{None: []string{"conventional"}}, []string{"organic"}, true},
+		{"none present", tagCondition{None: []string{"conventional"}}, []string{"organic", "conventional"}, false},
+		{"none without values", tagCondition{None: []string{"conventional"}}, nil, true},
+		{"combined", tagCondition{All: []string{"organic"}, Any: []string{"delivery", "parking"}, None: []string{"self-service"}}, []string{"organic", "parking"}, true},
+		{"combined excluded", tagCondition{All: []string{"organic"}, Any: []string{"delivery", "parking"}, None: []string{"self-service"}}, []string{"organic", "parking", "self-service"}, false},
+	}
+	for _, test := range tests {
+		if got := test.condition.matches(test.values); got != test.want {
+			t.Errorf("%s: matches(%v) = %v, expected %v", test.name, test.values, got, test.want)
+		}
+	}
+}
+
+func TestTagConditionMatchesExpandedTags(t *testing.T) {
+	expand := func(tag string) []string {
+		if tag == "cheese" {
+			return []string{"cheese", "goat-cheese"}
+		}
+		return []string{tag}
+	}
+	tests := []struct {
+		name      string
+		condition tagCondition
+		values    []string
+		want      bool
+	}{
+		{"all", tagCondition{All: []string{"cheese", "eggs"}, expand: expand}, []string{"goat-cheese", "eggs"}, true},
+		{"any", tagCondition{Any: []string{"cheese", "honey"}, expand: expand}, []string{"goat-cheese"}, true},
+		{"none", tagCondition{None: []string{"cheese"}, expand: expand}, []string{"goat-cheese"}, false},
+	}
+	for _, test := range tests {
+		if got := test.condition.matches(test.values); got != test.want {
+			t.Errorf("%s: matches(%v) = %v, expected %v", test.name, test.values, got, test.want)
+		}
+	}
+}
+
+func TestFarmerFilterMatches(t *testing.T) {
+	filter := farmerFilter{
+		"groceryTypes": {Any: []string{"eggs", "honey"}},
+		"features":     {None: []string{"conventional"}},
+	}
+	tests := []struct {
+		farmer farmer
+		want   bool
+	}{
+		{farmer{GroceryTypes: []string{"honey"}, Features: []string{"organic"}}, true},
+		{farmer{GroceryTypes: []string{"honey"}, Features: []string{"conventional"}}, false},
+		{farmer{GroceryTypes: []string{"milk"}}, false},
+	}
+	for _, test := range tests {
+		if got := filter.matches(test.farmer); got != test.want {
+			t.Errorf("matches(%v, %v) = %v, expected %v", test.farmer.GroceryTypes, test.farmer.Features, got, test.want)
+		}
+	}
+	if !(farmerFilter{}).matches(farmer{}) {
+		t.Error("Expected the empty filter to match every farmer")
+	}
+}
+
+func TestFarmerFilterMongoQuery(t *testing.T) {
+	if got := (farmerFilter{}).mongoQuery(); len(got) != 0 {
+		t.Errorf("Expected an empty query for the empty filter, got %v", got)
+	}
+
+	filter := farmerFilter{
+		"groceryTypes": {All: []string{"eggs", "honey"}, Any: []string{"milk", "cheese"}},
+		"features":     {None: []string{"conventional", "self-service"}},
+	}
+	want := bson.D{{"$and", bson.A{
+		bson.D{{"groceryTypes", bson.D{{"$in", []string{"eggs"}}}}},
+		bson.D{{"groceryTypes", bson.D{{"$in", []string{"honey"}}}}},
+		bson.D{{"groceryTypes", bson.D{{"$in", []string{"milk", "cheese"}}}}},
+		bson.D{{"features", bson.D{{"$nin", []string{"conventional", "self-service"}}}}},
+	}}}
+	if got := filter.mongoQuery(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestParseFarmerFilter(t *testing.T) {
+	query := url.Values{
+		"filter_groceryTypes_any": {"eggs,,honey"},
+		"filter_features":         {"organic"},
+		"filter_features_none":    {"conventional"},
+	}
+	filter := parseFarmerFilter(query, &taxonomy{})
+	if _, ok := filter["groceryTypes"]; !ok || len(filter) != 2 {
+		t.Fatalf("Expected conditions on grocery types and features, got %v", filter)
+	}
+	groceryTypes := filter["groceryTypes"]
+	if len(groceryTypes.All) != 0 || !reflect.DeepEqual(groceryTypes.Any, []string{"eggs", "honey"}) || len(groceryTypes.None) != 0 {
+		t.Errorf("Unexpected grocery type condition %+v", groceryTypes)
+	}
+	features := filter["features"]
+	if !reflect.DeepEqual(features.All, []string{"organic"}) || len(features.Any) != 0 || !reflect.DeepEqual(features.None, []string{"conventional"}) {
+		t.Errorf("Unexpected feature condition %+v", features)
+	}
+
+	if filter := parseFarmerFilter(url.Values{"filter_unknown": {"x"}}, &taxonomy{}); len(filter) != 0 {
+		t.Errorf("Expected unknown fields to be ignored, got %v", filter)
+	}
+}
+
+func TestSplitTags(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", []string{}},
+		{"eggs", []string{"eggs"}},
+		{"eggs,honey", []string{"eggs", "honey"}},
+		{",eggs,,honey,", []string{"eggs", "honey"}},
+	}
+	for _, test := range tests {
+		if got := splitTags(test.s); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitTags(%q) = %v, expected %v", test.s, got, test.want)
+		}
+	}
+}
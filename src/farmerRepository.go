@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FarmerRepository stores farmers. Changes that affect a farmer's geo point
+// are recorded in the geo index outbox atomically with the change itself.
+type FarmerRepository interface {
+	// FindByIDs returns the verified farmers with the given (hex) ids that
+	// match the tags filter.
+	FindByIDs(ids []string, tags farmerFilter) ([]farmer, error)
+	// FindNearBy returns the verified farmers within maxDistance_km of point
+	// that match the tags filter, with their distance set. It scans the farmer
+	// locations without a geo index and is only meant as a fallback while the
+	// geo index is unavailable.
+	FindNearBy(point geoLocation, maxDistance_km float64, tags farmerFilter) ([]farmer, error)
+	// Get returns the farmer or errFarmerNotFound.
+	Get(id primitive.ObjectID) (farmer, error)
+	// Insert stores a new farmer and returns it with its id set.
+	Insert(farmer farmer) (farmer, error)
+	// Update applies the non-empty fields of changes, merging the fields of
+	// address and location one by one, and returns the updated farmer.
+	Update(id primitive.ObjectID, changes farmer) (farmer, error)
+	// Replace overwrites the farmer with the same id.
+	Replace(farmer farmer) error
+	// Delete removes the farmer together with their products.
+	Delete(id primitive.ObjectID) error
+	// SetStatus moves the farmer to the status of change and appends change
+	// to the farmer's status history, provided the farmer is in one of the
+	// from statuses. Otherwise it returns errInvalidStatusTransition.
+	SetStatus(id primitive.ObjectID, from []string, change farmerStatusChange) (farmer, error)
+	// Locations returns the location of every farmer that belongs in the geo
+	// index, that is every verified farmer, keyed by hex id.
+	Locations() (map[string]geoLocation, error)
+	// Features returns the features of every farmer that has any, whatever
+	// their status.
+	Features() (map[primitive.ObjectID][]string, error)
+}
+
+// farmerPatchSubdocuments are merged field by field on PATCH, all other
+// fields are replaced as a whole.
+var farmerPatchSubdocuments = []string{"address", "location"}
+
+// mongoFarmerRepository keeps farmers in the `farmers` collection.
+type mongoFarmerRepository struct{}
+
+func (mongoFarmerRepository) FindByIDs(ids []string, tags farmerFilter) ([]farmer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("farmers")
+
+	// convert ids to bson object ids
+	objectIds := make([]primitive.ObjectID, 0)
+	for _, id := range ids {
+		objectId, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, err
+		}
+		objectIds = append(objectIds, objectId)
+	}
+	// the geo index only holds verified farmers, but may lag behind
+	filter := bson.D{{"$and", bson.A{
+		bson.D{{"_id", bson.D{{"$in", objectIds}}}},
+		tags.mongoQuery(),
+		verifiedFarmerFilter,
+	}}}
+	// sort := bson.D{{"date_ordered", 1}}
+	opts := options.Find() //.SetSort(sort)
+
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []farmer = make([]farmer, 0)
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (mongoFarmerRepository) FindNearBy(point geoLocation, maxDistance_km float64, tags farmerFilter) ([]farmer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("farmers")
+
+	// narrow the scan down to the bounding box of the circle, the exact
+	// distance is checked below
+	filter := bson.D{{"$and", bson.A{tags.mongoQuery(), verifiedFarmerFilter}}}
+	box := boundingBoxOf(point, maxDistance_km*1000)
+	filter = append(filter, bson.E{Key: "location.latitude", Value: bson.D{{"$gte", box.MinLatitude}, {"$lte", box.MaxLatitude}}})
+	if box.MinLongitude <= box.MaxLongitude {
+		filter = append(filter, bson.E{Key: "location.longitude", Value: bson.D{{"$gte", box.MinLongitude}, {"$lte", box.MaxLongitude}}})
+	} else {
+		// the box crosses the antimeridian
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{"location.longitude", bson.D{{"$gte", box.MinLongitude}}}},
+			bson.D{{"location.longitude", bson.D{{"$lte", box.MaxLongitude}}}},
+		}})
+	}
+	cursor, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []farmer = make([]farmer, 0)
+	if err = cursor.All(ctx, &candidates); err != nil {
+		return nil, err
+	}
+	return withinDistance(candidates, point, maxDistance_km), nil
+}
+
+func (mongoFarmerRepository) Get(farmerObjectId primitive.ObjectID) (farmer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return farmer{}, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("farmers")
+	filter := bson.D{{"_id", bson.D{{"$eq", farmerObjectId}}}}
+	var result farmer
+	err = coll.FindOne(ctx, filter).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return farmer{}, errFarmerNotFound
+	}
+	if err != nil {
+		return farmer{}, err
+	}
+	return result, nil
+}
+
+func (mongoFarmerRepository) Insert(farmer farmer) (farmer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return farmer, err
+	}
+
+	// Insert farmer and record the pending geo index write in one transaction
+	db := client.Database("shopGreenDB")
+	err = withMongoTransaction(ctx, client, func(ctx mongo.SessionContext) error {
+		result, err := db.Collection("farmers").InsertMany(ctx, []interface{}{farmer})
+		if err != nil {
+			return err
+		}
+		if len(result.InsertedIDs) != 1 {
+			return fmt.Errorf("Expected 1 inserted id, got %d", len(result.InsertedIDs))
+		}
+		farmer.MongoDbID = result.InsertedIDs[0].(primitive.ObjectID)
+		if !farmer.isVerified() {
+			return nil
+		}
+		return enqueueGeoIndexWrite(ctx, db, farmer.MongoDbID, geoIndexOutboxUpsert, farmer.Location)
+	})
+	if err != nil {
+		return farmer, err
+	}
+	return farmer, nil
+}
+
+func (mongoFarmerRepository) Update(farmerObjectId primitive.ObjectID, changes farmer) (farmer, error) {
+	patch, err := toMongoPatch(changes, farmerPatchSubdocuments)
+	if err != nil {
+		return farmer{}, err
+	}
+	moveGeoPoint := changes.Location != (geoLocation{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return farmer{}, err
+	}
+
+	db := client.Database("shopGreenDB")
+	filter := bson.D{{"_id", bson.D{{"$eq", farmerObjectId}}}}
+	var result farmer
+	if len(patch) <= 0 {
+		err = db.Collection("farmers").FindOne(ctx, filter).Decode(&result)
+	} else {
+		err = withMongoTransaction(ctx, client, func(ctx mongo.SessionContext) error {
+			update := bson.D{{"$set", patch}}
+			opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+			err := db.Collection("farmers").FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+			if err != nil || !moveGeoPoint || !result.isVerified() {
+				return err
+			}
+			return enqueueGeoIndexWrite(ctx, db, farmerObjectId, geoIndexOutboxUpsert, result.Location)
+		})
+	}
+	if err == mongo.ErrNoDocuments {
+		return farmer{}, errFarmerNotFound
+	}
+	if err != nil {
+		return farmer{}, err
+	}
+	return result, nil
+}
+
+func (mongoFarmerRepository) Replace(farmer farmer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	db := client.Database("shopGreenDB")
+	return withMongoTransaction(ctx, client, func(ctx mongo.SessionContext) error {
+		filter := bson.D{{"_id", bson.D{{"$eq", farmer.MongoDbID}}}}
+		result, err := db.Collection("farmers").ReplaceOne(ctx, filter, farmer)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount <= 0 {
+			return errFarmerNotFound
+		}
+		return enqueueGeoIndexWrite(ctx, db, farmer.MongoDbID, geoIndexOperationFor(farmer), farmer.Location)
+	})
+}
+
+func (mongoFarmerRepository) Delete(farmerObjectId primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	db := client.Database("shopGreenDB")
+	return withMongoTransaction(ctx, client, func(ctx mongo.SessionContext) error {
+		filter := bson.D{{"_id", bson.D{{"$eq", farmerObjectId}}}}
+		result, err := db.Collection("farmers").DeleteOne(ctx, filter)
+		if err != nil {
+			return err
+		}
+		if result.DeletedCount <= 0 {
+			return errFarmerNotFound
+		}
+
+		// a farmer's products are of no use without the farmer
+		filter = bson.D{{"farmerId", bson.D{{"$eq", farmerObjectId}}}}
+		_, err = db.Collection("products").DeleteMany(ctx, filter)
+		if err != nil {
+			return err
+		}
+		return enqueueGeoIndexWrite(ctx, db, farmerObjectId, geoIndexOutboxDelete, geoLocation{})
+	})
+}
+
+func (mongoFarmerRepository) SetStatus(farmerObjectId primitive.ObjectID, from []string, change farmerStatusChange) (farmer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return farmer{}, err
+	}
+
+	db := client.Database("shopGreenDB")
+	var result farmer
+	err = withMongoTransaction(ctx, client, func(ctx mongo.SessionContext) error {
+		// the status is part of the filter, so concurrent changes cannot both
+		// succeed from the same status
+		filter := bson.D{
+			{"_id", bson.D{{"$eq", farmerObjectId}}},
+			{"$and", bson.A{farmerStatusFilter(from)}},
+		}
+		update := bson.D{
+			{"$set", bson.D{{"status", change.Status}}},
+			{"$push", bson.D{{"statusHistory", change}}},
+		}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err := db.Collection("farmers").FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+		if err == mongo.ErrNoDocuments {
+			count, err := db.Collection("farmers").CountDocuments(ctx, bson.D{{"_id", bson.D{{"$eq", farmerObjectId}}}})
+			if err != nil {
+				return err
+			}
+			if count <= 0 {
+				return errFarmerNotFound
+			}
+			return errInvalidStatusTransition
+		}
+		if err != nil {
+			return err
+		}
+		return enqueueGeoIndexWrite(ctx, db, farmerObjectId, geoIndexOperationFor(result), result.Location)
+	})
+	if err != nil {
+		return farmer{}, err
+	}
+	return result, nil
+}
+
+func (mongoFarmerRepository) Locations() (map[string]geoLocation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("farmers")
+	opts := options.Find().SetProjection(bson.D{{"_id", 1}, {"location", 1}})
+	cursor, err := coll.Find(ctx, verifiedFarmerFilter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var farmers []farmer
+	if err = cursor.All(ctx, &farmers); err != nil {
+		return nil, err
+	}
+	locations := make(map[string]geoLocation, len(farmers))
+	for _, farmer := range farmers {
+		locations[farmer.MongoDbID.Hex()] = farmer.Location
+	}
+	return locations, nil
+}
+
+func (mongoFarmerRepository) Features() (map[primitive.ObjectID][]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("farmers")
+	filter := bson.D{{"features.0", bson.D{{"$exists", true}}}}
+	opts := options.Find().SetProjection(bson.D{{"_id", 1}, {"features", 1}})
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var farmers []farmer
+	if err = cursor.All(ctx, &farmers); err != nil {
+		return nil, err
+	}
+	features := make(map[primitive.ObjectID][]string, len(farmers))
+	for _, farmer := range farmers {
+		features[farmer.MongoDbID] = farmer.Features
+	}
+	return features, nil
+}
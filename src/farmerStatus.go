@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A farmer starts out pending and only shows up in search and in the geo
+// index once an admin verified them. Admins may suspend verified farmers and
+// approve them again, and archive farmers for good.
+const (
+	farmerStatusPending   = "pending"
+	farmerStatusVerified  = "verified"
+	farmerStatusSuspended = "suspended"
+	farmerStatusArchived  = "archived"
+)
+
+// farmerStatusChange records who moved a farmer to a status and when.
+type farmerStatusChange struct {
+	Status    string    `bson:"status" json:"status"`
+	ChangedAt time.Time `bson:"changedAt" json:"changedAt"`
+	ChangedBy string    `bson:"changedBy,omitempty" json:"changedBy,omitempty"`
+	Reason    string    `bson:"reason,omitempty" json:"reason,omitempty"`
+}
+
+// farmerStatusAction is a transition admins can apply to a farmer.
+type farmerStatusAction struct {
+	To   string
+	From []string
+}
+
+var farmerStatusActions = map[string]farmerStatusAction{
+	"approve": {To: farmerStatusVerified, From: []string{farmerStatusPending, farmerStatusSuspended}},
+	"suspend": {To: farmerStatusSuspended, From: []string{farmerStatusPending, farmerStatusVerified}},
+	"archive": {To: farmerStatusArchived, From: []string{farmerStatusPending, farmerStatusVerified, farmerStatusSuspended}},
+}
+
+var errInvalidStatusTransition = errors.New("Invalid status transition")
+
+// isVerified reports whether the farmer may be found by shoppers. Farmers
+// stored before statuses were introduced have none and count as verified.
+func (f farmer) isVerified() bool {
+	return f.Status == farmerStatusVerified || len(f.Status) <= 0
+}
+
+// statusOrVerified returns the farmer's status, reading a missing one as
+// verified like isVerified does.
+func (f farmer) statusOrVerified() string {
+	if len(f.Status) <= 0 {
+		return farmerStatusVerified
+	}
+	return f.Status
+}
+
+// verifiedFarmerFilter is the MongoDB query equivalent of isVerified.
+var verifiedFarmerFilter = bson.D{{"$or", bson.A{
+	bson.D{{"status", farmerStatusVerified}},
+	bson.D{{"status", bson.D{{"$exists", false}}}},
+}}}
+
+// farmerStatusFilter matches farmers in one of the statuses, again reading a
+// missing status as verified.
+func farmerStatusFilter(statuses []string) bson.D {
+	conditions := bson.A{bson.D{{"status", bson.D{{"$in", statuses}}}}}
+	for _, status := range statuses {
+		if status == farmerStatusVerified {
+			conditions = append(conditions, bson.D{{"status", bson.D{{"$exists", false}}}})
+		}
+	}
+	return bson.D{{"$or", conditions}}
+}
+
+// geoIndexOperationFor returns how the farmer has to be reflected in the geo
+// index: indexed if verified and removed otherwise.
+func geoIndexOperationFor(f farmer) string {
+	if f.isVerified() {
+		return geoIndexOutboxUpsert
+	}
+	return geoIndexOutboxDelete
+}
+
+// changeFarmerStatus applies the named action to the farmer on behalf of the
+// given user, recording the change in the farmer's status history.
+func (app *app) changeFarmerStatus(farmerId string, action string, changedBy string, reason string) (farmer, error) {
+	farmerObjectId, err := fromJsonFarmerId(farmerId)
+	if err != nil {
+		return farmer{}, err
+	}
+	transition, ok := farmerStatusActions[action]
+	if !ok {
+		return farmer{}, errInvalidStatusTransition
+	}
+
+	change := farmerStatusChange{
+		Status:    transition.To,
+		ChangedAt: time.Now().UTC(),
+		ChangedBy: changedBy,
+		Reason:    reason,
+	}
+	updated, err := app.farmers.SetStatus(farmerObjectId, transition.From, change)
+	if err != nil {
+		return farmer{}, err
+	}
+	app.flushGeoIndexOutbox(farmerObjectId)
+
+	updated.ID = toJsonFarmerId(updated.MongoDbID)
+	setOpeningStatus(&updated, time.Now())
+	return updated, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"golang.org/x/exp/maps"
+)
+
+// GeoIndex stores the locations of farmers and answers radius queries. Farmers
+// are identified by the hex representation of their MongoDB id.
+type GeoIndex interface {
+	// Insert adds the farmer at the given location or moves it there if it is
+	// already indexed.
+	Insert(id string, location geoLocation) error
+	// Delete removes the farmer. Deleting an unknown id is not an error.
+	Delete(id string) error
+	// QueryRadius returns the ids of the farmers within maxDistance_km of
+	// point, mapped to their distance from point in meters. Of more than
+	// maxRadiusResults farmers, only the nearest are returned.
+	QueryRadius(point geoLocation, maxDistance_km float64) (map[string]float64, error)
+	// All returns the locations of all indexed farmers.
+	All() (map[string]geoLocation, error)
+}
+
+// maxRadiusResults caps the farmers a search considers. A search runs in full
+// for every page it is requested for, as its filters, text matching and sort
+// order are applied in process, so the cap bounds the work per page.
+const maxRadiusResults = 5000
+
+// nearest returns the maxRadiusResults entries of idsAndDistances with the
+// smallest distances.
+func nearest(idsAndDistances map[string]float64) map[string]float64 {
+	if len(idsAndDistances) <= maxRadiusResults {
+		return idsAndDistances
+	}
+	ids := maps.Keys(idsAndDistances)
+	sort.Slice(ids, func(i, j int) bool {
+		if idsAndDistances[ids[i]] != idsAndDistances[ids[j]] {
+			return idsAndDistances[ids[i]] < idsAndDistances[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	result := make(map[string]float64, maxRadiusResults)
+	for _, id := range ids[:maxRadiusResults] {
+		result[id] = idsAndDistances[id]
+	}
+	return result
+}
+
+// errGeoIndexUnavailable is wrapped by errors of geo indexes that could not
+// be reached, as opposed to errors of requests the geo index rejected.
+var errGeoIndexUnavailable = errors.New("Geo index unavailable")
+
+// newGeoIndex returns the geo index backend with the given name, as
+// configured by the GEO_INDEX environment variable. Kinetica is the default.
+func newGeoIndex(name string) (GeoIndex, error) {
+	switch name {
+	case "", "kinetica":
+		return newKineticaGeoIndex(), nil
+	case "memory":
+		return newMemoryGeoIndex(), nil
+	case "mongo":
+		return &mongoGeoIndex{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown geo index: %s", name)
+	}
+}
+
+// size of a grid cell of the in-memory index in degrees
+const memoryGeoIndexCellSize = 0.25
+
+type gridCell struct {
+	Row    int
+	Column int
+}
+
+const gridColumnsPerTurn = int(360 / memoryGeoIndexCellSize)
+
+func gridCellOf(location geoLocation) gridCell {
+	return gridCell{
+		Row:    int(math.Floor(location.Latitude / memoryGeoIndexCellSize)),
+		Column: wrapGridColumn(int(math.Floor(location.Longitude / memoryGeoIndexCellSize))),
+	}
+}
+
+// wrapGridColumn maps columns beyond the antimeridian back into [-180, 180).
+func wrapGridColumn(column int) int {
+	column = (column + gridColumnsPerTurn/2) % gridColumnsPerTurn
+	if column < 0 {
+		column += gridColumnsPerTurn
+	}
+	return column - gridColumnsPerTurn/2
+}
+
+// memoryGeoIndex is an in-process GeoIndex that buckets locations into a
+// fixed grid and computes haversine distances for the candidates in the cells
+// a query touches. Its contents live only as long as the process, which makes
+// it suitable for local development and tests rather than production.
+type memoryGeoIndex struct {
+	mutex     sync.RWMutex
+	locations map[string]geoLocation
+	cells     map[gridCell]map[string]struct{}
+}
+
+func newMemoryGeoIndex() *memoryGeoIndex {
+	return &memoryGeoIndex{
+		locations: make(map[string]geoLocation),
+		cells:     make(map[gridCell]map[string]struct{}),
+	}
+}
+
+func (index *memoryGeoIndex) Insert(id string, location geoLocation) error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.remove(id)
+	index.locations[id] = location
+	cell := gridCellOf(location)
+	if index.cells[cell] == nil {
+		index.cells[cell] = make(map[string]struct{})
+	}
+	index.cells[cell][id] = struct{}{}
+	return nil
+}
+
+func (index *memoryGeoIndex) Delete(id string) error {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.remove(id)
+	return nil
+}
+
+// remove must be called with the mutex held.
+func (index *memoryGeoIndex) remove(id string) {
+	location, ok := index.locations[id]
+	if !ok {
+		return
+	}
+	cell := gridCellOf(location)
+	delete(index.cells[cell], id)
+	if len(index.cells[cell]) <= 0 {
+		delete(index.cells, cell)
+	}
+	delete(index.locations, id)
+}
+
+func (index *memoryGeoIndex) QueryRadius(point geoLocation, maxDistance_km float64) (map[string]float64, error) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	maxDistance_m := maxDistance_km * 1000
+	idsAndDistances := make(map[string]float64)
+	for _, cell := range index.cellsWithin(point, maxDistance_m) {
+		for id := range index.cells[cell] {
+			distance_m := haversineDistance_m(point, index.locations[id])
+			if distance_m < maxDistance_m {
+				idsAndDistances[id] = distance_m
+			}
+		}
+	}
+	return nearest(idsAndDistances), nil
+}
+
+func (index *memoryGeoIndex) All() (map[string]geoLocation, error) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	locations := make(map[string]geoLocation, len(index.locations))
+	for id, location := range index.locations {
+		locations[id] = location
+	}
+	return locations, nil
+}
+
+// cellsWithin returns the occupied cells intersecting the bounding box of the
+// circle around point. Near the poles, or when the box spans the whole globe,
+// all occupied cells are returned.
+func (index *memoryGeoIndex) cellsWithin(point geoLocation, radius_m float64) []gridCell {
+	dLat := radius_m / earthRadius_m * 180 / math.Pi
+	minLat, maxLat := point.Latitude-dLat, point.Latitude+dLat
+	cosLat := math.Min(math.Cos(degreesToRadians(minLat)), math.Cos(degreesToRadians(maxLat)))
+	if minLat <= -90 || maxLat >= 90 || cosLat <= 0 {
+		return index.allCells()
+	}
+	dLon := dLat / cosLat
+	if dLon >= 180 {
+		return index.allCells()
+	}
+	minRow := int(math.Floor(minLat / memoryGeoIndexCellSize))
+	maxRow := int(math.Floor(maxLat / memoryGeoIndexCellSize))
+	minColumn := int(math.Floor((point.Longitude - dLon) / memoryGeoIndexCellSize))
+	maxColumn := int(math.Floor((point.Longitude + dLon) / memoryGeoIndexCellSize))
+	// scanning the occupied cells is cheaper than probing a larger box
+	if (maxRow-minRow+1)*(maxColumn-minColumn+1) > len(index.cells) {
+		return index.allCells()
+	}
+
+	cells := make([]gridCell, 0)
+	for row := minRow; row <= maxRow; row++ {
+		for column := minColumn; column <= maxColumn; column++ {
+			cell := gridCell{Row: row, Column: wrapGridColumn(column)}
+			if _, ok := index.cells[cell]; ok {
+				cells = append(cells, cell)
+			}
+		}
+	}
+	return cells
+}
+
+func (index *memoryGeoIndex) allCells() []gridCell {
+	cells := make([]gridCell, 0, len(index.cells))
+	for cell := range index.cells {
+		cells = append(cells, cell)
+	}
+	return cells
+}
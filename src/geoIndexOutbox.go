@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The geo index outbox records pending writes to the geo index in the same
+// MongoDB transaction as the farmer change that causes them. Entries are
+// applied right after the transaction commits and retried with backoff until
+// the geo index acknowledges them, so MongoDB and the geo index converge even
+// if the geo index is temporarily unavailable.
+//
+// There is at most one entry per farmer, keyed by the farmer id. Upserts and
+// deletes both describe the complete desired state of the farmer in the geo
+// index, so a newer entry simply replaces an older one that was not applied
+// yet, which keeps the order of writes per farmer intact.
+
+const (
+	geoIndexOutboxUpsert = "upsert"
+	geoIndexOutboxDelete = "delete"
+)
+
+// how long a processor may work on an entry before others may pick it up
+const geoIndexOutboxLease = time.Minute
+
+// upper bound of the delay between two attempts
+const geoIndexOutboxMaxBackoff = time.Hour
+
+// how long the scheduled function may retry due entries, well within the 30
+// seconds Netlify gives scheduled functions
+const geoIndexOutboxFunctionTimeout = 20 * time.Second
+
+// geoIndexOutboxFunction is set in the binary of the scheduled Netlify
+// function that retries the outbox on AWS Lambda, where nothing runs between
+// requests, see geoIndexOutboxFunction.go.
+var geoIndexOutboxFunction = false
+
+type geoIndexOutboxEntry struct {
+	FarmerID primitive.ObjectID `bson:"_id"`
+	// Version changes whenever the entry is replaced, so that a processor
+	// never removes an entry newer than the one it applied
+	Version       primitive.ObjectID `bson:"version"`
+	Operation     string             `bson:"operation"`
+	Location      geoLocation        `bson:"location"`
+	Attempts      int32              `bson:"attempts"`
+	LastError     string             `bson:"lastError,omitempty"`
+	CreatedAt     time.Time          `bson:"createdAt"`
+	NextAttemptAt time.Time          `bson:"nextAttemptAt"`
+}
+
+// enqueueGeoIndexWrite records the desired geo index state of the farmer. It
+// is meant to be called inside the transaction changing the farmer.
+func enqueueGeoIndexWrite(ctx context.Context, db *mongo.Database, farmerObjectId primitive.ObjectID, operation string, location geoLocation) error {
+	now := time.Now()
+	entry := geoIndexOutboxEntry{
+		FarmerID:      farmerObjectId,
+		Version:       primitive.NewObjectID(),
+		Operation:     operation,
+		Location:      location,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+	filter := bson.D{{"_id", bson.D{{"$eq", farmerObjectId}}}}
+	opts := options.Replace().SetUpsert(true)
+	_, err := db.Collection("geoIndexOutbox").ReplaceOne(ctx, filter, entry, opts)
+	return err
+}
+
+// geoIndexOutboxBackoff returns the delay after the given number of failed
+// attempts: 5s, 10s, 20s, ... up to geoIndexOutboxMaxBackoff.
+func geoIndexOutboxBackoff(attempts int32) time.Duration {
+	backoff := 5 * time.Second
+	for i := int32(1); i < attempts && backoff < geoIndexOutboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > geoIndexOutboxMaxBackoff {
+		backoff = geoIndexOutboxMaxBackoff
+	}
+	return backoff
+}
+
+// GeoIndexOutbox gives access to the pending geo index writes. Entries are
+// added by the FarmerRepository as part of the farmer changes causing them.
+type GeoIndexOutbox interface {
+	// Due returns up to limit entries whose next attempt is due at now, only
+	// considering the given farmer's entry if farmerObjectId is not nil.
+	Due(farmerObjectId *primitive.ObjectID, now time.Time, limit int) ([]geoIndexOutboxEntry, error)
+	// Claim postpones the entry to until so that concurrent processors skip
+	// it. It reports false if the entry is no longer due or was replaced.
+	Claim(entry geoIndexOutboxEntry, now time.Time, until time.Time) (bool, error)
+	// Complete removes the entry unless it was replaced in the meantime.
+	Complete(entry geoIndexOutboxEntry) error
+	// Retry records a failed attempt and schedules the next one at next.
+	Retry(entry geoIndexOutboxEntry, lastError string, next time.Time) error
+	// FarmerIDs returns the hex ids of all farmers with a pending entry.
+	FarmerIDs() (map[string]bool, error)
+}
+
+// mongoGeoIndexOutbox keeps the outbox in the `geoIndexOutbox` collection.
+type mongoGeoIndexOutbox struct{}
+
+func (mongoGeoIndexOutbox) Due(farmerObjectId *primitive.ObjectID, now time.Time, limit int) ([]geoIndexOutboxEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("geoIndexOutbox")
+	filter := bson.D{{"nextAttemptAt", bson.D{{"$lte", now}}}}
+	if farmerObjectId != nil {
+		filter = append(filter, bson.E{Key: "_id", Value: *farmerObjectId})
+	}
+	opts := options.Find().SetSort(bson.D{{"nextAttemptAt", 1}}).SetLimit(int64(limit))
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var entries []geoIndexOutboxEntry = make([]geoIndexOutboxEntry, 0)
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (mongoGeoIndexOutbox) Claim(entry geoIndexOutboxEntry, now time.Time, until time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("geoIndexOutbox")
+	filter := bson.D{
+		{"_id", entry.FarmerID},
+		{"version", entry.Version},
+		{"nextAttemptAt", bson.D{{"$lte", now}}},
+	}
+	update := bson.D{{"$set", bson.D{{"nextAttemptAt", until}}}}
+	result, err := coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+func (mongoGeoIndexOutbox) Complete(entry geoIndexOutboxEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("geoIndexOutbox")
+	filter := bson.D{{"_id", entry.FarmerID}, {"version", entry.Version}}
+	_, err = coll.DeleteOne(ctx, filter)
+	return err
+}
+
+func (mongoGeoIndexOutbox) Retry(entry geoIndexOutboxEntry, lastError string, next time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("geoIndexOutbox")
+	filter := bson.D{{"_id", entry.FarmerID}, {"version", entry.Version}}
+	update := bson.D{
+		{"$inc", bson.D{{"attempts", 1}}},
+		{"$set", bson.D{
+			{"lastError", lastError},
+			{"nextAttemptAt", next},
+		}},
+	}
+	_, err = coll.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (mongoGeoIndexOutbox) FarmerIDs() (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("geoIndexOutbox")
+	opts := options.Find().SetProjection(bson.D{{"_id", 1}})
+	cursor, err := coll.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		FarmerID primitive.ObjectID `bson:"_id"`
+	}
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	pending := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		pending[entry.FarmerID.Hex()] = true
+	}
+	return pending, nil
+}
+
+func (app *app) applyGeoIndexOutboxEntry(entry geoIndexOutboxEntry) error {
+	if entry.Operation == geoIndexOutboxDelete {
+		return app.geoIndex.Delete(entry.FarmerID.Hex())
+	}
+	return app.geoIndex.Insert(entry.FarmerID.Hex(), entry.Location)
+}
+
+// processGeoIndexOutbox applies up to limit due outbox entries, or only the
+// entry of the given farmer if farmerObjectId is not nil. It returns the
+// number of entries applied; entries that fail are rescheduled. Once ctx is
+// done, no further entry is started.
+func (app *app) processGeoIndexOutbox(ctx context.Context, farmerObjectId *primitive.ObjectID, limit int) (int, error) {
+	now := time.Now()
+	entries, err := app.outbox.Due(farmerObjectId, now, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		// claim the entry so that concurrent processors skip it
+		claimed, err := app.outbox.Claim(entry, now, time.Now().Add(geoIndexOutboxLease))
+		if err != nil {
+			return applied, err
+		}
+		if !claimed {
+			continue
+		}
+
+		err = app.applyGeoIndexOutboxEntry(entry)
+		if err != nil {
+			log.Printf("Geo index %s of farmer %s failed (attempt %d): %s", entry.Operation, entry.FarmerID.Hex(), entry.Attempts+1, err)
+			next := time.Now().Add(geoIndexOutboxBackoff(entry.Attempts + 1))
+			if err := app.outbox.Retry(entry, err.Error(), next); err != nil {
+				return applied, err
+			}
+			continue
+		}
+		if err := app.outbox.Complete(entry); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// flushGeoIndexOutbox tries to apply the farmer's pending geo index write
+// right away. Failures are only logged, the entry stays in the outbox.
+func (app *app) flushGeoIndexOutbox(farmerObjectId primitive.ObjectID) {
+	if _, err := app.processGeoIndexOutbox(context.Background(), &farmerObjectId, 1); err != nil {
+		log.Print(err)
+	}
+}
+
+// processGeoIndexOutboxPeriodically retries due outbox entries until ctx is
+// done. It is used when serving HTTP directly, where the server may sit idle.
+func (app *app) processGeoIndexOutboxPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := app.processGeoIndexOutbox(ctx, nil, 100); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// serveGeoIndexOutboxFunction handles the invocations of the scheduled
+// Netlify function, whatever their path, by retrying the due outbox entries
+// for up to geoIndexOutboxFunctionTimeout.
+func (app *app) serveGeoIndexOutboxFunction(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), geoIndexOutboxFunctionTimeout)
+	defer cancel()
+	applied, err := app.processGeoIndexOutbox(ctx, nil, 100)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	log.Printf("Applied %d geo index outbox entries", applied)
+	w.WriteHeader(http.StatusNoContent)
+}
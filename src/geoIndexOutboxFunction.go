@@ -0,0 +1,10 @@
+//go:build outboxfunction
+
+package main
+
+// build.sh builds the binary a second time with this file as the
+// processGeoIndexOutbox function, which netlify.toml schedules to retry the
+// due geo index writes every minute.
+func init() {
+	geoIndexOutboxFunction = true
+}
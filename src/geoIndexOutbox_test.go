@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// flakyGeoIndex fails the next failures writes and then behaves like the
+// in-memory index.
+type flakyGeoIndex struct {
+	*memoryGeoIndex
+	failures int
+}
+
+func (index *flakyGeoIndex) Insert(id string, location geoLocation) error {
+	if index.failures > 0 {
+		index.failures--
+		return errGeoIndexUnavailable
+	}
+	return index.memoryGeoIndex.Insert(id, location)
+}
+
+// newOutboxTestApp returns an app with an in-memory outbox holding an upsert
+// of one farmer, and the store behind it.
+func newOutboxTestApp(failures int) (*app, *memoryStore, primitive.ObjectID) {
+	app := newMemoryApp(&flakyGeoIndex{memoryGeoIndex: newMemoryGeoIndex(), failures: failures})
+	store := app.outbox.(memoryGeoIndexOutbox).store
+	farmerObjectId := primitive.NewObjectID()
+	store.mutex.Lock()
+	store.enqueueGeoIndexWrite(farmerObjectId, geoIndexOutboxUpsert, geoLocation{Longitude: 13.4, Latitude: 52.5})
+	store.mutex.Unlock()
+	return app, store, farmerObjectId
+}
+
+func TestGeoIndexOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int32
+		want     time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{10, 2560 * time.Second},
+		{11, geoIndexOutboxMaxBackoff},
+		{1000, geoIndexOutboxMaxBackoff},
+	}
+	for _, test := range tests {
+		if got := geoIndexOutboxBackoff(test.attempts); got != test.want {
+			t.Errorf("geoIndexOutboxBackoff(%d) = %s, expected %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestProcessGeoIndexOutboxRetriesUntilApplied(t *testing.T) {
+	app, store, farmerObjectId := newOutboxTestApp(2)
+
+	for attempt := int32(1); attempt <= 2; attempt++ {
+		before := time.Now()
+		applied, err := app.processGeoIndexOutbox(context.Background(), nil, 100)
+		if err != nil || applied != 0 {
+			t.Fatalf("Attempt %d: expected nothing applied, got %d, %v", attempt, applied, err)
+		}
+		entry := store.outbox[farmerObjectId]
+		if entry.Attempts != attempt || len(entry.LastError) <= 0 {
+			t.Fatalf("Attempt %d: expected the failure to be recorded, got %+v", attempt, entry)
+		}
+		if entry.NextAttemptAt.Before(before.Add(geoIndexOutboxBackoff(attempt))) {
+			t.Fatalf("Attempt %d: expected a backoff of %s, next attempt is at %s", attempt, geoIndexOutboxBackoff(attempt), entry.NextAttemptAt)
+		}
+
+		// entries are not retried before their backoff passed
+		if applied, _ := app.processGeoIndexOutbox(context.Background(), nil, 100); applied != 0 || store.outbox[farmerObjectId].Attempts != attempt {
+			t.Fatalf("Attempt %d: expected the entry to wait for its backoff", attempt)
+		}
+		entry.NextAttemptAt = time.Now()
+		store.outbox[farmerObjectId] = entry
+	}
+
+	applied, err := app.processGeoIndexOutbox(context.Background(), nil, 100)
+	if err != nil || applied != 1 {
+		t.Fatalf("Expected the entry to be applied, got %d, %v", applied, err)
+	}
+	if _, ok := store.outbox[farmerObjectId]; ok {
+		t.Error("Expected the entry to be removed once applied")
+	}
+	locations, _ := app.geoIndex.All()
+	if _, ok := locations[farmerObjectId.Hex()]; !ok {
+		t.Error("Expected the farmer to be in the geo index")
+	}
+}
+
+func TestGeoIndexOutboxKeepsNewerEntry(t *testing.T) {
+	app, store, farmerObjectId := newOutboxTestApp(0)
+	entries, err := app.outbox.Due(nil, time.Now(), 100)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected 1 due entry, got %v, %v", entries, err)
+	}
+
+	// the farmer moves while the old entry is being applied
+	store.mutex.Lock()
+	store.enqueueGeoIndexWrite(farmerObjectId, geoIndexOutboxDelete, geoLocation{})
+	store.mutex.Unlock()
+	if err := app.outbox.Complete(entries[0]); err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := store.outbox[farmerObjectId]; !ok || entry.Operation != geoIndexOutboxDelete {
+		t.Errorf("Expected the newer entry to remain, got %+v", entry)
+	}
+	if claimed, _ := app.outbox.Claim(entries[0], time.Now(), time.Now().Add(time.Minute)); claimed {
+		t.Error("Expected a replaced entry not to be claimed")
+	}
+}
+
+func TestServeGeoIndexOutboxFunction(t *testing.T) {
+	app, store, farmerObjectId := newOutboxTestApp(0)
+	recorder := httptest.NewRecorder()
+	app.serveGeoIndexOutboxFunction(recorder, httptest.NewRequest("POST", "/.netlify/functions/processGeoIndexOutbox", nil))
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if _, ok := store.outbox[farmerObjectId]; ok {
+		t.Error("Expected the due entry to be applied")
+	}
+}
+
+func TestServeGeoIndexOutboxFunctionRecordsFailures(t *testing.T) {
+	app, store, farmerObjectId := newOutboxTestApp(1)
+	recorder := httptest.NewRecorder()
+	app.serveGeoIndexOutboxFunction(recorder, httptest.NewRequest("POST", "/.netlify/functions/processGeoIndexOutbox", nil))
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if entry := store.outbox[farmerObjectId]; entry.Attempts != 1 || entry.LastError != errGeoIndexUnavailable.Error() {
+		t.Errorf("Expected the failed attempt to be recorded, got %+v", entry)
+	}
+}
+
+func TestProcessGeoIndexOutboxStopsWhenDone(t *testing.T) {
+	app, store, farmerObjectId := newOutboxTestApp(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if applied, err := app.processGeoIndexOutbox(ctx, nil, 100); applied != 0 || err != nil {
+		t.Errorf("Expected nothing to be applied after ctx is done, got %d, %v", applied, err)
+	}
+	if entry, ok := store.outbox[farmerObjectId]; !ok || entry.Attempts != 0 {
+		t.Errorf("Expected the entry to be left untouched, got %+v", entry)
+	}
+}
@@ -1,6 +1,64 @@
 package main
 
+import "math"
+
 type geoLocation struct {
 	Longitude float64 `bson:"longitude,omitempty" json:"longitude,omitempty"`
 	Latitude  float64 `bson:"latitude,omitempty" json:"latitude,omitempty"`
 }
+
+// mean earth radius in meters
+const earthRadius_m = 6371008.8
+
+func degreesToRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// haversineDistance_m returns the great-circle distance between a and b in meters.
+func haversineDistance_m(a geoLocation, b geoLocation) float64 {
+	lat1 := degreesToRadians(a.Latitude)
+	lat2 := degreesToRadians(b.Latitude)
+	dLat := lat2 - lat1
+	dLon := degreesToRadians(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius_m * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// boundingBox is an area between two latitudes and two longitudes. If it
+// crosses the antimeridian, MinLongitude is greater than MaxLongitude.
+type boundingBox struct {
+	MinLongitude float64
+	MaxLongitude float64
+	MinLatitude  float64
+	MaxLatitude  float64
+}
+
+// boundingBoxOf returns a box containing every location within radius_m of
+// center. Near the poles it spans all longitudes.
+func boundingBoxOf(center geoLocation, radius_m float64) boundingBox {
+	dLat := radius_m / earthRadius_m * 180 / math.Pi
+	box := boundingBox{
+		MinLongitude: -180,
+		MaxLongitude: 180,
+		MinLatitude:  math.Max(-90, center.Latitude-dLat),
+		MaxLatitude:  math.Min(90, center.Latitude+dLat),
+	}
+	if box.MinLatitude <= -90 || box.MaxLatitude >= 90 {
+		return box
+	}
+	// the widest point of the circle is at a latitude closer to the pole than
+	// its center, asin accounts for that
+	dLon := math.Asin(math.Min(1, math.Sin(radius_m/earthRadius_m)/math.Cos(degreesToRadians(center.Latitude)))) * 180 / math.Pi
+	if dLon >= 180 {
+		return box
+	}
+	box.MinLongitude = center.Longitude - dLon
+	box.MaxLongitude = center.Longitude + dLon
+	if box.MinLongitude < -180 {
+		box.MinLongitude += 360
+	}
+	if box.MaxLongitude > 180 {
+		box.MaxLongitude -= 360
+	}
+	return box
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Geocoder resolves addresses into locations.
+type Geocoder interface {
+	// Geocode returns the location of the address, or errAddressNotFound if
+	// the address cannot be resolved to a single place.
+	Geocode(address address) (geoLocation, error)
+}
+
+var errAddressNotFound = errors.New("Address not found")
+
+// places of an address farther apart than this, such as villages of the same
+// name, make it ambiguous
+const maxPlaceSpread_km = 25
+
+// postalCodes is a small extract of the GeoNames postal code dataset, enough
+// for development and tests. Production points GEOCODER_DATASET at the full
+// download of the countries it serves.
+//
+//go:embed data/postalCodes.txt
+var postalCodes string
+
+// newGeocoder returns the offline geocoder backed by the GeoNames postal code
+// file at path, as configured by the GEOCODER_DATASET environment variable.
+// Without a path it uses the embedded extract.
+func newGeocoder(path string) (Geocoder, error) {
+	if len(path) <= 0 {
+		return newOfflineGeocoder(strings.NewReader(postalCodes))
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return newOfflineGeocoder(file)
+}
+
+// postalCodePlace is a place of the dataset. A postal code may cover several
+// places and a place several postal codes.
+type postalCodePlace struct {
+	Country    string
+	PostalCode string
+	Name       string
+	Location   geoLocation
+}
+
+// offlineGeocoder geocodes from a GeoNames postal code file held in memory,
+// so it needs no network access. It resolves to the postal code area, or to
+// the city if there is no postal code, which is precise enough to find
+// farmers nearby.
+type offlineGeocoder struct {
+	// places by normalized postal code, of all countries
+	byPostalCode map[string][]postalCodePlace
+	// places by normalized name, of all countries
+	byName map[string][]postalCodePlace
+}
+
+// newOfflineGeocoder reads the tab separated GeoNames format: country code,
+// postal code, place name, three pairs of admin name and code, latitude,
+// longitude and accuracy. See
+// https://download.geonames.org/export/zip/readme.txt.
+func newOfflineGeocoder(r io.Reader) (*offlineGeocoder, error) {
+	geocoder := &offlineGeocoder{
+		byPostalCode: make(map[string][]postalCodePlace),
+		byName:       make(map[string][]postalCodePlace),
+	}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) <= 0 {
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 12 {
+			return nil, fmt.Errorf("Invalid postal code dataset, line %d has %d fields instead of 12", line, len(fields))
+		}
+		latitude, err := strconv.ParseFloat(fields[9], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid postal code dataset, line %d: %s", line, err)
+		}
+		longitude, err := strconv.ParseFloat(fields[10], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid postal code dataset, line %d: %s", line, err)
+		}
+		place := postalCodePlace{
+			Country:    strings.ToUpper(fields[0]),
+			PostalCode: fields[1],
+			Name:       fields[2],
+			Location:   geoLocation{Longitude: longitude, Latitude: latitude},
+		}
+		postalCode := normalizePostalCode(place.PostalCode)
+		geocoder.byPostalCode[postalCode] = append(geocoder.byPostalCode[postalCode], place)
+		name := normalizePlaceName(place.Name)
+		geocoder.byName[name] = append(geocoder.byName[name], place)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return geocoder, nil
+}
+
+func normalizePostalCode(postalCode string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(postalCode), " ", ""))
+}
+
+func normalizePlaceName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// Geocode prefers the postal code and narrows its places down to the city if
+// that is given too. The result is the center of the matching places, which
+// must lie in one country and close to each other.
+func (geocoder *offlineGeocoder) Geocode(address address) (geoLocation, error) {
+	city := normalizePlaceName(address.City)
+	var places []postalCodePlace
+	if postalCode := normalizePostalCode(address.ZipCode); len(postalCode) > 0 {
+		places = inCountry(geocoder.byPostalCode[postalCode], address.Country)
+		if len(city) > 0 {
+			inCity := make([]postalCodePlace, 0, len(places))
+			for _, place := range places {
+				if normalizePlaceName(place.Name) == city {
+					inCity = append(inCity, place)
+				}
+			}
+			// postal codes often name the municipality rather than the
+			// village, so an unknown city does not rule the postal code out
+			if len(inCity) > 0 {
+				places = inCity
+			}
+		}
+	} else if len(city) > 0 {
+		places = inCountry(geocoder.byName[city], address.Country)
+	}
+
+	if len(places) <= 0 {
+		return geoLocation{}, errAddressNotFound
+	}
+	var location geoLocation
+	for _, place := range places {
+		if place.Country != places[0].Country {
+			return geoLocation{}, fmt.Errorf("%w: it is ambiguous without a country", errAddressNotFound)
+		}
+		location.Longitude += place.Location.Longitude
+		location.Latitude += place.Location.Latitude
+	}
+	location.Longitude /= float64(len(places))
+	location.Latitude /= float64(len(places))
+	for _, place := range places {
+		if haversineDistance_m(location, place.Location) > maxPlaceSpread_km*1000 {
+			return geoLocation{}, fmt.Errorf("%w: it matches places too far apart", errAddressNotFound)
+		}
+	}
+	return location, nil
+}
+
+// inCountry returns the places in the country, or all places if country is
+// empty.
+func inCountry(places []postalCodePlace, country string) []postalCodePlace {
+	if len(country) <= 0 {
+		return places
+	}
+	result := make([]postalCodePlace, 0, len(places))
+	for _, place := range places {
+		if place.Country == strings.ToUpper(country) {
+			result = append(result, place)
+		}
+	}
+	return result
+}
@@ -7,6 +7,7 @@ require (
 	github.com/gorilla/mux v1.8.0
 	go.mongodb.org/mongo-driver v1.11.6
 	golang.org/x/exp v0.0.0-20230522175609-2e198f4a06a1
+	golang.org/x/text v0.3.7
 )
 
 require (
@@ -22,5 +23,4 @@ require (
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
 	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
-	golang.org/x/text v0.3.7 // indirect
 )
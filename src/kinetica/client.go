@@ -0,0 +1,158 @@
+// Package kinetica is a small client for the Kinetica REST API, covering the
+// endpoints the backend uses: SQL queries with bound parameters and typed
+// rows, and inserting records as JSON.
+package kinetica
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds a single request when the client is created with
+// NewClient.
+const DefaultTimeout = 10 * time.Second
+
+// Client sends requests to one Kinetica instance. It is safe for concurrent
+// use.
+type Client struct {
+	// BaseURL is the URL of the REST API, e.g. https://host:8082/gpudb-0
+	BaseURL string
+	// Authorization is sent as the Authorization header, if set
+	Authorization string
+	// HTTPClient is used for all requests
+	HTTPClient *http.Client
+	// Retry applies to idempotent requests only
+	Retry RetryPolicy
+	// Breaker, if set, stops requests while Kinetica is unavailable
+	Breaker *Breaker
+}
+
+// NewClient returns a client for the given base URL using its own HTTP client
+// with DefaultTimeout, DefaultRetryPolicy and a breaker that opens for 30
+// seconds after 5 consecutive failures.
+func NewClient(baseURL string, authorization string) *Client {
+	return &Client{
+		BaseURL:       strings.TrimSuffix(baseURL, "/"),
+		Authorization: authorization,
+		HTTPClient:    &http.Client{Timeout: DefaultTimeout},
+		Retry:         DefaultRetryPolicy,
+		Breaker:       NewBreaker(5, 30*time.Second),
+	}
+}
+
+// Error is returned when Kinetica answers a request with a status other than
+// OK.
+type Error struct {
+	// Endpoint is the path of the request, e.g. /execute/sql
+	Endpoint string
+	// Status is the status reported by Kinetica, usually ERROR
+	Status string
+	// Message is Kinetica's description of the problem
+	Message string
+	// StatusCode is the HTTP status code of the response
+	StatusCode int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Kinetica %s failed with status %s (HTTP %d): %s", e.Endpoint, e.Status, e.StatusCode, e.Message)
+}
+
+// response is the envelope of every Kinetica response. The actual response
+// is JSON encoded in DataStr and described by DataType.
+type response struct {
+	Status   string `json:"status"`
+	Message  string `json:"message"`
+	DataType string `json:"data_type"`
+	DataStr  string `json:"data_str"`
+}
+
+// call sends the request through the circuit breaker, retrying it according
+// to the retry policy if it is idempotent and Kinetica was unavailable.
+func (c *Client) call(ctx context.Context, endpoint string, query url.Values, request interface{}, dataType string, result interface{}, idempotent bool) error {
+	if c.Breaker != nil && !c.Breaker.allow() {
+		return ErrCircuitOpen
+	}
+
+	attempts := 1
+	if idempotent && c.Retry.MaxAttempts > 1 {
+		attempts = c.Retry.MaxAttempts
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = c.post(ctx, endpoint, query, request, dataType, result)
+		if err == nil || !IsUnavailable(err) || attempt >= attempts {
+			break
+		}
+		timer := time.NewTimer(c.Retry.delay(attempt))
+		select {
+		case <-timer.C:
+			continue
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		break
+	}
+
+	if c.Breaker != nil {
+		c.Breaker.record(!IsUnavailable(err))
+	}
+	return err
+}
+
+// post sends request as JSON to the endpoint, with the optional query
+// parameters, and decodes the response data, which must be of the given data
+// type, into result.
+func (c *Client) post(ctx context.Context, endpoint string, query url.Values, request interface{}, dataType string, result interface{}) error {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	u := c.BaseURL + endpoint
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(c.Authorization) > 0 {
+		req.Header.Set("Authorization", c.Authorization)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return &unavailableError{err}
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return &unavailableError{err}
+	}
+	var resp response
+	if err := json.Unmarshal(body, &resp); err != nil {
+		// typically an error page of a proxy in front of Kinetica
+		return &unavailableError{fmt.Errorf("Kinetica %s returned HTTP %d with an unreadable body: %w", endpoint, res.StatusCode, err)}
+	}
+	if resp.Status != "OK" {
+		return &Error{Endpoint: endpoint, Status: resp.Status, Message: resp.Message, StatusCode: res.StatusCode}
+	}
+	if resp.DataType != dataType {
+		return fmt.Errorf("Kinetica %s returned data_type %s (expected %s)", endpoint, resp.DataType, dataType)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(resp.DataStr), result); err != nil {
+		return fmt.Errorf("Kinetica %s returned an unreadable %s: %w", endpoint, dataType, err)
+	}
+	return nil
+}
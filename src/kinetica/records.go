@@ -0,0 +1,25 @@
+package kinetica
+
+import (
+	"context"
+	"net/url"
+)
+
+type insertRecordsResponse struct {
+	CountInserted int64 `json:"count_inserted"`
+	CountUpdated  int64 `json:"count_updated"`
+}
+
+// InsertRecords inserts records, a slice of values marshalled to JSON objects
+// keyed by column name, into table. Records whose primary key already exists
+// are updated if updateOnExistingPK is set, which also makes the request
+// idempotent and therefore retried.
+func (c *Client) InsertRecords(ctx context.Context, table string, records interface{}, updateOnExistingPK bool) error {
+	query := url.Values{}
+	query.Set("table_name", table)
+	if updateOnExistingPK {
+		query.Set("update_on_existing_pk", "true")
+	}
+	var resp insertRecordsResponse
+	return c.call(ctx, "/insert/records/json", query, records, "insert_records_from_payload_response", &resp, updateOnExistingPK)
+}
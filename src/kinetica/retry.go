@@ -0,0 +1,132 @@
+package kinetica
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting Kinetica while the client's
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("Kinetica circuit breaker is open")
+
+// RetryPolicy bounds the retries of idempotent requests. The delay before the
+// n-th retry is chosen at random between zero and BaseDelay * 2^(n-1), capped
+// at MaxDelay, so that clients failing together do not retry together.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy is used by clients created with NewClient.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 2 * time.Second}
+
+var (
+	jitterMutex sync.Mutex
+	jitter      = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// delay returns the randomized delay before the given retry, starting at 1.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	ceiling := p.BaseDelay
+	for i := 1; i < retry && ceiling < p.MaxDelay; i++ {
+		ceiling *= 2
+	}
+	if ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	jitterMutex.Lock()
+	defer jitterMutex.Unlock()
+	return time.Duration(jitter.Int63n(int64(ceiling) + 1))
+}
+
+// unavailableError marks failures to get an answer from Kinetica at all, as
+// opposed to Kinetica rejecting a request.
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+// IsUnavailable reports whether err means that Kinetica could not be reached
+// or failed on its side, including ErrCircuitOpen. Such requests may succeed
+// when retried later, unlike requests Kinetica rejected.
+func IsUnavailable(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	var unavailable *unavailableError
+	if errors.As(err, &unavailable) {
+		return true
+	}
+	var kineticaErr *Error
+	return errors.As(err, &kineticaErr) && (kineticaErr.StatusCode >= 500 || kineticaErr.StatusCode == 429)
+}
+
+// Breaker is a circuit breaker. After FailureThreshold consecutive requests
+// found Kinetica unavailable it opens and requests fail fast with
+// ErrCircuitOpen. Once OpenDuration has passed, a single request is let
+// through as a probe; it closes the breaker again if it succeeds.
+type Breaker struct {
+	FailureThreshold int
+	OpenDuration     time.Duration
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewBreaker returns a closed circuit breaker.
+func NewBreaker(failureThreshold int, openDuration time.Duration) *Breaker {
+	return &Breaker{FailureThreshold: failureThreshold, OpenDuration: openDuration}
+}
+
+// IsOpen reports whether requests are currently failing fast.
+func (b *Breaker) IsOpen() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.failures >= b.FailureThreshold && (time.Now().Before(b.openUntil) || b.probing)
+}
+
+// allow reports whether a request may be sent. Every allowed request must be
+// followed by a call to record.
+func (b *Breaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failures < b.FailureThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record notes the outcome of an allowed request.
+func (b *Breaker) record(available bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+	if available {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.FailureThreshold {
+		b.openUntil = time.Now().Add(b.OpenDuration)
+	}
+}
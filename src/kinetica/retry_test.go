@@ -0,0 +1,208 @@
+package kinetica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	ceilings := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, ceiling := range ceilings {
+		retry := i + 1
+		for n := 0; n < 100; n++ {
+			if d := p.delay(retry); d < 0 || d > ceiling {
+				t.Fatalf("delay(%d) = %s, expected between 0 and %s", retry, d, ceiling)
+			}
+		}
+	}
+	if d := (RetryPolicy{}).delay(1); d != 0 {
+		t.Errorf("Expected no delay without a base delay, got %s", d)
+	}
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := NewBreaker(2, time.Hour)
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("Request %d: expected the closed breaker to allow requests", i+1)
+		}
+		b.record(false)
+	}
+	if !b.IsOpen() {
+		t.Fatal("Expected the breaker to open after 2 failures")
+	}
+	if b.allow() {
+		t.Error("Expected the open breaker to reject requests")
+	}
+}
+
+func TestBreakerResetsOnSuccess(t *testing.T) {
+	b := NewBreaker(2, time.Hour)
+	b.allow()
+	b.record(false)
+	b.allow()
+	b.record(true)
+	b.allow()
+	b.record(false)
+	if b.IsOpen() {
+		t.Error("Expected only consecutive failures to open the breaker")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b := NewBreaker(1, time.Hour)
+	b.allow()
+	b.record(false)
+
+	// the open duration passes
+	b.openUntil = time.Now()
+	if !b.allow() {
+		t.Fatal("Expected a probe to be allowed after the open duration")
+	}
+	if b.allow() {
+		t.Error("Expected only a single probe at a time")
+	}
+	if !b.IsOpen() {
+		t.Error("Expected the breaker to stay open while probing")
+	}
+
+	// a failed probe opens it again
+	b.record(false)
+	if !b.IsOpen() || b.allow() {
+		t.Fatal("Expected a failed probe to open the breaker again")
+	}
+
+	b.openUntil = time.Now()
+	if !b.allow() {
+		t.Fatal("Expected a second probe to be allowed")
+	}
+	b.record(true)
+	if b.IsOpen() {
+		t.Error("Expected a successful probe to close the breaker")
+	}
+	if !b.allow() || !b.allow() {
+		t.Error("Expected the closed breaker to allow requests")
+	}
+}
+
+func TestIsUnavailable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrCircuitOpen, true},
+		{&unavailableError{errors.New("connection refused")}, true},
+		{&Error{StatusCode: http.StatusServiceUnavailable}, true},
+		{&Error{StatusCode: http.StatusTooManyRequests}, true},
+		{&Error{StatusCode: http.StatusBadRequest}, false},
+		{errors.New("unexpected data_type"), false},
+	}
+	for _, test := range tests {
+		if got := IsUnavailable(test.err); got != test.want {
+			t.Errorf("IsUnavailable(%v) = %v, expected %v", test.err, got, test.want)
+		}
+	}
+}
+
+// newTestServer returns a server answering /execute/sql that fails the first
+// failures requests with the given status code, and a pointer to the number
+// of requests received.
+func newTestServer(t *testing.T, failures int, statusCode int) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		resp := response{Status: "OK", DataType: "execute_sql_response", DataStr: `{"count_affected":1}`}
+		if requests <= failures {
+			resp = response{Status: "ERROR", Message: "try again"}
+			w.WriteHeader(statusCode)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func newTestClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: http.DefaultClient,
+		Retry:      RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		Breaker:    NewBreaker(5, time.Hour),
+	}
+}
+
+func TestCallRetriesIdempotentRequests(t *testing.T) {
+	server, requests := newTestServer(t, 2, http.StatusServiceUnavailable)
+	c := newTestClient(server.URL)
+	count, err := c.Exec(context.Background(), true, "DELETE FROM farmers WHERE id = $1", "f-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || *requests != 3 {
+		t.Errorf("Expected 1 record affected after 3 requests, got %d after %d", count, *requests)
+	}
+	if c.Breaker.failures != 0 {
+		t.Errorf("Expected the eventual success to count for the breaker, got %d failures", c.Breaker.failures)
+	}
+}
+
+func TestCallGivesUpAfterMaxAttempts(t *testing.T) {
+	server, requests := newTestServer(t, 10, http.StatusServiceUnavailable)
+	c := newTestClient(server.URL)
+	_, err := c.Exec(context.Background(), true, "DELETE FROM farmers")
+	if !IsUnavailable(err) || *requests != 3 {
+		t.Errorf("Expected unavailable after 3 requests, got %v after %d", err, *requests)
+	}
+	if c.Breaker.failures != 1 {
+		t.Errorf("Expected the retried call to count as 1 failure, got %d", c.Breaker.failures)
+	}
+}
+
+func TestCallDoesNotRetryNonIdempotentRequests(t *testing.T) {
+	server, requests := newTestServer(t, 1, http.StatusServiceUnavailable)
+	c := newTestClient(server.URL)
+	if _, err := c.Exec(context.Background(), false, "INSERT INTO farmers VALUES ($1)", "f-1"); !IsUnavailable(err) {
+		t.Errorf("Expected unavailable, got %v", err)
+	}
+	if *requests != 1 {
+		t.Errorf("Expected 1 request, got %d", *requests)
+	}
+}
+
+func TestCallDoesNotRetryRejections(t *testing.T) {
+	server, requests := newTestServer(t, 1, http.StatusBadRequest)
+	c := newTestClient(server.URL)
+	_, err := c.Exec(context.Background(), true, "DELETE FROM nowhere")
+	var kineticaErr *Error
+	if !errors.As(err, &kineticaErr) || kineticaErr.Message != "try again" {
+		t.Fatalf("Expected Kinetica's error, got %v", err)
+	}
+	if *requests != 1 {
+		t.Errorf("Expected 1 request, got %d", *requests)
+	}
+	if c.Breaker.failures != 0 {
+		t.Errorf("Expected a rejection not to count for the breaker, got %d failures", c.Breaker.failures)
+	}
+}
+
+func TestCallFailsFastWhileOpen(t *testing.T) {
+	server, requests := newTestServer(t, 10, http.StatusServiceUnavailable)
+	c := newTestClient(server.URL)
+	c.Retry.MaxAttempts = 1
+	c.Breaker = NewBreaker(2, time.Hour)
+	for i := 0; i < 2; i++ {
+		c.Exec(context.Background(), true, "DELETE FROM farmers")
+	}
+	if _, err := c.Exec(context.Background(), true, "DELETE FROM farmers"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if *requests != 2 {
+		t.Errorf("Expected no request while open, got %d requests", *requests)
+	}
+}
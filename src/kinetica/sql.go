@@ -0,0 +1,186 @@
+package kinetica
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// PageSize is the number of rows Query requests per page.
+const PageSize = 1000
+
+// how long Kinetica keeps the paging table of a query between two pages, in
+// minutes
+const pagingTableTTL = "5"
+
+type executeSqlRequest struct {
+	Statement string            `json:"statement"`
+	Offset    int               `json:"offset"`
+	Limit     int               `json:"limit"`
+	Encoding  string            `json:"encoding"`
+	Options   map[string]string `json:"options"`
+}
+
+type executeSqlResponse struct {
+	CountAffected        int64             `json:"count_affected"`
+	JsonEncodedResponse  string            `json:"json_encoded_response"`
+	TotalNumberOfRecords int64             `json:"total_number_of_records"`
+	HasMoreRecords       bool              `json:"has_more_records"`
+	PagingTable          string            `json:"paging_table"`
+	Info                 map[string]string `json:"info"`
+}
+
+// Result is one page of the result of a SQL statement.
+type Result struct {
+	// CountAffected is the number of records changed by a DML statement
+	CountAffected int64
+	// HasMoreRecords is set if there are rows after this page
+	HasMoreRecords bool
+	// PagingTable holds the remaining pages if HasMoreRecords is set
+	PagingTable string
+	// Rows are the rows of this page, each a JSON object keyed by column name
+	Rows []json.RawMessage
+}
+
+// Scan decodes the rows of the result into dest, which must be a pointer to
+// a slice. Columns are matched to fields by their json tags, and a column
+// that does not fit its field is reported as an error.
+func (r Result) Scan(dest interface{}) error {
+	b, err := json.Marshal(r.Rows)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, dest); err != nil {
+		return fmt.Errorf("Cannot scan Kinetica rows: %w", err)
+	}
+	return nil
+}
+
+// Execute runs statement with params bound to its $1, $2, ... placeholders
+// and returns the page of rows starting at offset. Pages after the first one
+// should pass the paging table of the previous page.
+// Execute is not retried, since the statement may not be idempotent.
+func (c *Client) Execute(ctx context.Context, statement string, params []interface{}, offset int, limit int, pagingTable string) (Result, error) {
+	return c.execute(ctx, statement, params, offset, limit, pagingTable, false)
+}
+
+func (c *Client) execute(ctx context.Context, statement string, params []interface{}, offset int, limit int, pagingTable string, idempotent bool) (Result, error) {
+	options := map[string]string{"paging_table_ttl": pagingTableTTL}
+	if len(pagingTable) > 0 {
+		options["paging_table"] = pagingTable
+	}
+	if len(params) > 0 {
+		// parameters travel separately from the statement, so values never
+		// need to be quoted or escaped
+		b, err := json.Marshal(params)
+		if err != nil {
+			return Result{}, err
+		}
+		options["query_parameters"] = string(b)
+	}
+	request := executeSqlRequest{
+		Statement: statement,
+		Offset:    offset,
+		Limit:     limit,
+		Encoding:  "json",
+		Options:   options,
+	}
+
+	var resp executeSqlResponse
+	err := c.call(ctx, "/execute/sql", nil, request, "execute_sql_response", &resp, idempotent)
+	if err != nil {
+		return Result{}, err
+	}
+	result := Result{
+		CountAffected:  resp.CountAffected,
+		HasMoreRecords: resp.HasMoreRecords,
+		PagingTable:    resp.PagingTable,
+	}
+	if len(resp.JsonEncodedResponse) > 0 {
+		result.Rows, err = rowsOf(resp.JsonEncodedResponse)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	return result, nil
+}
+
+// Query runs statement, which must be a query, with params bound and returns
+// all rows, decoded into values of type T. It pages through the result until
+// Kinetica reports no more records. Every page is retried as needed.
+func Query[T any](ctx context.Context, c *Client, statement string, params ...interface{}) ([]T, error) {
+	rows := make([]T, 0)
+	offset := 0
+	pagingTable := ""
+	for {
+		result, err := c.execute(ctx, statement, params, offset, PageSize, pagingTable, true)
+		if err != nil {
+			return nil, err
+		}
+		var page []T
+		if err := result.Scan(&page); err != nil {
+			return nil, err
+		}
+		rows = append(rows, page...)
+		if !result.HasMoreRecords || len(page) <= 0 {
+			break
+		}
+		offset += len(page)
+		pagingTable = result.PagingTable
+	}
+	return rows, nil
+}
+
+// Exec runs a statement that returns no rows, such as INSERT or DELETE, with
+// params bound and returns the number of records affected. The statement is
+// retried only if idempotent is set.
+func (c *Client) Exec(ctx context.Context, idempotent bool, statement string, params ...interface{}) (int64, error) {
+	result, err := c.execute(ctx, statement, params, 0, 0, "", idempotent)
+	if err != nil {
+		return 0, err
+	}
+	return result.CountAffected, nil
+}
+
+// rowsOf turns Kinetica's column oriented JSON encoding, which holds the
+// values of the n-th column in "column_n" and the column names in
+// "column_headers", into one JSON object per row.
+func rowsOf(jsonEncodedResponse string) ([]json.RawMessage, error) {
+	var columns map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(jsonEncodedResponse), &columns); err != nil {
+		return nil, err
+	}
+	var headers []string
+	if err := json.Unmarshal(columns["column_headers"], &headers); err != nil {
+		return nil, fmt.Errorf("Kinetica SQL response has no readable column_headers: %w", err)
+	}
+
+	values := make([][]json.RawMessage, len(headers))
+	for c := range headers {
+		name := "column_" + strconv.Itoa(c+1)
+		if err := json.Unmarshal(columns[name], &values[c]); err != nil {
+			return nil, fmt.Errorf("Kinetica SQL response has no readable %s: %w", name, err)
+		}
+		if len(values[c]) != len(values[0]) {
+			return nil, fmt.Errorf("Kinetica SQL response has %d values in %s but %d in column_1", len(values[c]), name, len(values[0]))
+		}
+	}
+
+	rows := make([]json.RawMessage, 0)
+	if len(headers) <= 0 {
+		return rows, nil
+	}
+	for r := range values[0] {
+		row := make(map[string]json.RawMessage, len(headers))
+		for c, header := range headers {
+			row[header] = values[c][r]
+		}
+		b, err := json.Marshal(row)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, b)
+	}
+	return rows, nil
+}
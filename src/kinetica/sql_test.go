@@ -0,0 +1,172 @@
+package kinetica
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRowsOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "rows",
+			encoded: `{"column_1": ["a", "b"], "column_2": [1.5, 2], "column_headers": ["id", "distance_m"], "column_datatypes": ["char32", "double"]}`,
+			want:    []string{`{"distance_m":1.5,"id":"a"}`, `{"distance_m":2,"id":"b"}`},
+		},
+		{
+			name:    "no columns",
+			encoded: `{"column_headers": []}`,
+			want:    []string{},
+		},
+		{
+			// values are passed on as they are, whatever Kinetica's type
+			name:    "unknown column type",
+			encoded: `{"column_1": [{"x": 1}], "column_headers": ["shape"], "column_datatypes": ["hyperloop"]}`,
+			want:    []string{`{"shape":{"x":1}}`},
+		},
+		{
+			name:    "unequal column lengths",
+			encoded: `{"column_1": ["a", "b"], "column_2": [1.5], "column_headers": ["id", "distance_m"]}`,
+			wantErr: true,
+		},
+		{
+			name:    "non-array column",
+			encoded: `{"column_1": "a", "column_headers": ["id"]}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing column",
+			encoded: `{"column_1": ["a"], "column_headers": ["id", "distance_m"]}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing headers",
+			encoded: `{"column_1": ["a"]}`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		rows, err := rowsOf(test.encoded)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.name, rows)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(rows) != len(test.want) {
+			t.Errorf("%s: expected %d rows, got %s", test.name, len(test.want), rows)
+			continue
+		}
+		for i, row := range rows {
+			if string(row) != test.want[i] {
+				t.Errorf("%s: expected row %d to be %s, got %s", test.name, i, test.want[i], row)
+			}
+		}
+	}
+}
+
+type testRow struct {
+	ID         string  `json:"id"`
+	Distance_m float64 `json:"distance_m"`
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		row     string
+		wantErr bool
+	}{
+		{"matching fields", `{"id": "a", "distance_m": 1.5}`, false},
+		{"unknown column", `{"id": "a", "name": "Hof"}`, false},
+		{"mismatched field type", `{"id": "a", "distance_m": "far"}`, true},
+		{"mismatched string field", `{"id": 7}`, true},
+	}
+	for _, test := range tests {
+		var rows []testRow
+		err := Result{Rows: []json.RawMessage{json.RawMessage(test.row)}}.Scan(&rows)
+		if test.wantErr != (err != nil) {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.wantErr, err)
+		}
+	}
+}
+
+// sqlResponse wraps the column encoded rows in the envelope of an
+// /execute/sql response.
+func sqlResponse(t *testing.T, encoded string, hasMoreRecords bool, pagingTable string) []byte {
+	t.Helper()
+	data, err := json.Marshal(executeSqlResponse{
+		JsonEncodedResponse: encoded,
+		HasMoreRecords:      hasMoreRecords,
+		PagingTable:         pagingTable,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(response{Status: "OK", DataType: "execute_sql_response", DataStr: string(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestQueryPagesThroughResult(t *testing.T) {
+	var requests []executeSqlRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request executeSqlRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, request)
+		if len(requests) == 1 {
+			w.Write(sqlResponse(t, `{"column_1": ["a", "b"], "column_2": [1, 2], "column_headers": ["id", "distance_m"]}`, true, "paging_1"))
+		} else {
+			w.Write(sqlResponse(t, `{"column_1": ["c"], "column_2": [3], "column_headers": ["id", "distance_m"]}`, false, ""))
+		}
+	}))
+	defer server.Close()
+
+	rows, err := Query[testRow](context.Background(), NewClient(server.URL, ""), "SELECT id, distance_m FROM farmers WHERE name = $1", "Hof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0].ID != "a" || rows[2].ID != "c" || rows[2].Distance_m != 3 {
+		t.Errorf("Expected the rows of both pages, got %+v", rows)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(requests))
+	}
+	if requests[1].Offset != 2 || requests[1].Options["paging_table"] != "paging_1" {
+		t.Errorf("Expected the second page to start at 2 in paging_1, got %d in %q", requests[1].Offset, requests[1].Options["paging_table"])
+	}
+	if requests[0].Options["query_parameters"] != `["Hof"]` {
+		t.Errorf("Expected the parameters to be bound, got %q", requests[0].Options["query_parameters"])
+	}
+}
+
+func TestQueryStopsOnEmptyPage(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(sqlResponse(t, `{"column_1": [], "column_2": [], "column_headers": ["id", "distance_m"]}`, true, "paging_1"))
+	}))
+	defer server.Close()
+
+	rows, err := Query[testRow](context.Background(), NewClient(server.URL, ""), "SELECT id, distance_m FROM farmers")
+	if err != nil || len(rows) != 0 {
+		t.Fatalf("Expected no rows, got %+v, %v", rows, err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected an empty page to end the query, got %d requests", requests)
+	}
+}
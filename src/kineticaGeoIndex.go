@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"shopgreen/backend/kinetica"
+)
+
+// kineticaGeoIndex keeps farmer locations in the Kinetica `farmers` table.
+type kineticaGeoIndex struct {
+	client *kinetica.Client
+}
+
+// newKineticaGeoIndex connects to the Kinetica instance configured by the
+// KINETICA_BASE_URL and KINETICA_AUTHORIZATION environment variables.
+func newKineticaGeoIndex() kineticaGeoIndex {
+	return kineticaGeoIndex{
+		client: kinetica.NewClient(os.Getenv("KINETICA_BASE_URL"), os.Getenv("KINETICA_AUTHORIZATION")),
+	}
+}
+
+// kineticaFarmer is a row of the `farmers` table.
+type kineticaFarmer struct {
+	ID        string  `json:"id"`
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
+}
+
+type kineticaFarmerDistance struct {
+	ID         string  `json:"id"`
+	Distance_m float64 `json:"distance_m"`
+}
+
+// kineticaGeoIndexError marks errors caused by Kinetica being unavailable
+// with errGeoIndexUnavailable.
+func kineticaGeoIndexError(err error) error {
+	if err != nil && kinetica.IsUnavailable(err) {
+		return fmt.Errorf("%w: %s", errGeoIndexUnavailable, err)
+	}
+	return err
+}
+
+func (index kineticaGeoIndex) Insert(id string, location geoLocation) error {
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kinetica.DefaultTimeout)
+	defer cancel()
+
+	records := []kineticaFarmer{{ID: id, Longitude: location.Longitude, Latitude: location.Latitude}}
+	err := index.client.InsertRecords(ctx, "farmers", records, true)
+	return kineticaGeoIndexError(err)
+}
+
+func (index kineticaGeoIndex) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kinetica.DefaultTimeout)
+	defer cancel()
+
+	_, err := index.client.Exec(ctx, true, "DELETE FROM farmers WHERE id = $1", id)
+	return kineticaGeoIndexError(err)
+}
+
+func (index kineticaGeoIndex) QueryRadius(point geoLocation, maxDistance_km float64) (map[string]float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := kinetica.Query[kineticaFarmerDistance](ctx, index.client,
+		fmt.Sprintf("SELECT id, GEODIST(longitude, latitude, $1, $2) AS distance_m FROM farmers WHERE GEODIST(longitude, latitude, $1, $2) < $3 ORDER BY distance_m LIMIT %d", maxRadiusResults),
+		point.Longitude, point.Latitude, maxDistance_km*1000)
+	if err != nil {
+		return nil, kineticaGeoIndexError(err)
+	}
+	idsAndDistances := make(map[string]float64, len(rows))
+	for _, row := range rows {
+		idsAndDistances[row.ID] = row.Distance_m
+	}
+	return idsAndDistances, nil
+}
+
+func (index kineticaGeoIndex) All() (map[string]geoLocation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	rows, err := kinetica.Query[kineticaFarmer](ctx, index.client, "SELECT id, longitude, latitude FROM farmers")
+	if err != nil {
+		return nil, kineticaGeoIndexError(err)
+	}
+	locations := make(map[string]geoLocation, len(rows))
+	for _, row := range rows {
+		locations[row.ID] = geoLocation{Longitude: row.Longitude, Latitude: row.Latitude}
+	}
+	return locations, nil
+}
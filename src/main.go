@@ -1,36 +1,193 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	_ "time/tzdata"
 
 	"github.com/carlmjohnson/gateway"
 	"github.com/gorilla/mux"
+	"golang.org/x/exp/slices"
 )
 
 func main() {
 	port := flag.Int("port", -1, "specify a port to use http rather than AWS Lambda")
+	reconcile := flag.Bool("reconcile", false, "diff the farmers in MongoDB against the geo index, report discrepancies and exit")
+	normalize := flag.Bool("normalizeTaxonomy", false, "rewrite the stored grocery types and features to taxonomy ids, report values that cannot be mapped and exit")
+	dryRun := flag.Bool("dry-run", true, "with -reconcile or -normalizeTaxonomy, only report; use -dry-run=false to repair")
+	issue := flag.Bool("issue-token", false, "print a token signed with AUTH_SIGNING_KEY for -subject and -role and exit")
+	subject := flag.String("subject", "", "with -issue-token, the user the token is for")
+	role := flag.String("role", roleShopper, "with -issue-token, one of shopper, farmer or admin")
+	ttl := flag.Duration("ttl", 24*time.Hour, "with -issue-token, how long the token is valid")
 	flag.Parse()
-	r := mux.NewRouter()
+
+	signingKey := []byte(os.Getenv("AUTH_SIGNING_KEY"))
+	if *issue {
+		token, err := issueToken(signingKey, *subject, *role, *ttl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(token)
+		return
+	}
+	if err := checkSigningKey(signingKey); err != nil {
+		log.Printf("AUTH_SIGNING_KEY is not usable, all tokens will be rejected: %s", err)
+	}
+
+	// the embedded postal codes cover a few places for development only, so
+	// production would reject most addresses
+	geocoderDataset := os.Getenv("GEOCODER_DATASET")
+	if *port == -1 && len(geocoderDataset) <= 0 {
+		log.Print("GEOCODER_DATASET is not set, only the embedded development postal codes can be geocoded")
+	}
+
+	app, err := newApp(os.Getenv("REPOSITORY"), os.Getenv("GEO_INDEX"), geocoderDataset, *port != -1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.signingKey = signingKey
+
+	if *reconcile {
+		unrepaired, err := app.reconcileGeoIndex(*dryRun, os.Stdout)
+		disconnectMongo(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if unrepaired > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if *normalize {
+		unknown, err := app.normalizeTaxonomy(*dryRun, os.Stdout)
+		disconnectMongo(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if unknown > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if geoIndexOutboxFunction {
+		err = gateway.ListenAndServe("", http.HandlerFunc(app.serveGeoIndexOutboxFunction))
+		disconnectMongo(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// done on SIGINT or SIGTERM, which shuts down the server in -port mode
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	allowedOrigins := os.Getenv("CORS_ALLOWED_ORIGINS")
+	if len(strings.TrimSpace(allowedOrigins)) <= 0 {
+		log.Print("CORS_ALLOWED_ORIGINS is not set, cross-origin requests will be refused")
+	}
+	r := newRouter(app, allowedOrigins)
 	listener := gateway.ListenAndServe
 	portStr := ""
 	if *port != -1 {
 		portStr = fmt.Sprintf(":%d", *port)
-		listener = http.ListenAndServe
+		listener = func(addr string, handler http.Handler) error {
+			return listenAndServeUntilDone(ctx, addr, handler)
+		}
 		r.Handle("/", http.FileServer(http.Dir("./public")))
+		go app.processGeoIndexOutboxPeriodically(ctx, 30*time.Second)
 	}
 
-	r.HandleFunc("/api/farmers/find", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+	err = listener(portStr, r)
+	disconnectMongo(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newRouter returns the router serving the API on top of the given app,
+// allowing cross-origin requests from the given comma separated origins.
+func newRouter(app *app, allowedOrigins string) *mux.Router {
+	r := mux.NewRouter()
+	r.Use(newCors(allowedOrigins).middleware, app.authenticate)
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, apiError{Code: errorCodeNotFound, Message: "No such endpoint: " + r.URL.Path})
+	})
+
+	r.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeMethodNotAllowed(w)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		status := http.StatusOK
+		health := map[string]string{"status": "ok", "mongo": "ok"}
+		if app.ping == nil {
+			delete(health, "mongo")
+		} else if err := app.ping(ctx); err != nil {
+			log.Print(err)
+			status = http.StatusServiceUnavailable
+			health["status"] = "unavailable"
+			health["mongo"] = err.Error()
+		}
+		b, err := json.Marshal(health)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		w.Write(b)
+	})
 
+	r.HandleFunc("/api/taxonomy/{vocabulary}", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			writeMethodNotAllowed(w)
+			return
+		}
+
+		var terms []*taxonomyTerm
+		switch mux.Vars(r)["vocabulary"] {
+		case "groceryTypes":
+			terms = app.taxonomy.GroceryTypes
+		case "features":
+			terms = app.taxonomy.Features
+		default:
+			writeError(w, http.StatusNotFound, apiError{Code: errorCodeNotFound, Message: "No such endpoint: " + r.URL.Path})
+			return
+		}
+		lang := taxonomyLanguage(r.URL.Query().Get("lang"), r.Header.Get("Accept-Language"))
+		b, err := json.Marshal(localize(terms, lang))
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Language", lang)
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Header().Add("Vary", "Accept-Language")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	})
+
+	r.HandleFunc("/api/farmers/find", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeMethodNotAllowed(w)
 			return
 		}
 
@@ -39,87 +196,248 @@ func main() {
 		var err error
 		if len(sLongitude) > 0 {
 			longitude, err = strconv.ParseFloat(sLongitude, 64)
-			if err != nil {
-				log.Print(err)
-				w.WriteHeader(http.StatusInternalServerError)
+			// written so that NaN fails the check
+			if err != nil || !(longitude >= -180 && longitude <= 180) {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'location_longitude' must be a number between -180 and 180.", Field: "location_longitude"})
 				return
 			}
 		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("The parameter 'location_longitude' is required."))
+			writeError(w, http.StatusBadRequest, apiError{Code: errorCodeMissingParameter, Message: "The parameter 'location_longitude' is required.", Field: "location_longitude"})
 			return
 		}
 		sLatitude := r.URL.Query().Get("location_latitude")
 		var latitude float64
 		if len(sLatitude) > 0 {
 			latitude, err = strconv.ParseFloat(sLatitude, 64)
-			if err != nil {
-				log.Print(err)
-				w.WriteHeader(http.StatusInternalServerError)
+			if err != nil || !(latitude >= -90 && latitude <= 90) {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'location_latitude' must be a number between -90 and 90.", Field: "location_latitude"})
 				return
 			}
 		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("The parameter 'location_latitude' is required."))
+			writeError(w, http.StatusBadRequest, apiError{Code: errorCodeMissingParameter, Message: "The parameter 'location_latitude' is required.", Field: "location_latitude"})
 			return
 		}
 		sMaxDistance_km := r.URL.Query().Get("maxDistance_km")
 		var maxDistance_km float64
 		if len(sMaxDistance_km) > 0 {
 			maxDistance_km, err = strconv.ParseFloat(sMaxDistance_km, 64)
-			if err != nil {
-				log.Print(err)
-				w.WriteHeader(http.StatusInternalServerError)
+			if err != nil || !(maxDistance_km > 0) || math.IsInf(maxDistance_km, 1) {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'maxDistance_km' must be a finite number greater than 0.", Field: "maxDistance_km"})
 				return
 			}
 		} else {
 			maxDistance_km = 50
 		}
-		sGroceryTypes := r.URL.Query().Get("filter_groceryTypes")
-		groceryTypes := make([]string, 0)
-		for _, groceryType := range strings.Split(sGroceryTypes, ",") {
-			if len(groceryType) > 0 {
-				groceryTypes = append(groceryTypes, groceryType)
+		tags := parseFarmerFilter(r.URL.Query(), app.taxonomy)
+		sOpeningHours := r.URL.Query().Get("filter_openingHours_ISO8601")
+		var openingHours *timeInterval
+		if len(sOpeningHours) > 0 {
+			// an unencoded '+' of a UTC offset arrives as a space
+			interval, err := parseISO8601Interval(strings.ReplaceAll(sOpeningHours, " ", "+"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'filter_openingHours_ISO8601' must be an ISO 8601 instant or interval: " + err.Error(), Field: "filter_openingHours_ISO8601"})
+				return
+			}
+			openingHours = &interval
+		}
+
+		text := r.URL.Query().Get("q")
+
+		sortBy := r.URL.Query().Get("sort")
+		if len(sortBy) <= 0 {
+			sortBy = farmerSortDistance
+			if len(searchTerms(text)) > 0 {
+				sortBy = farmerSortRelevance
+			}
+		} else if !isValidFarmerSort(sortBy) {
+			writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'sort' must be one of 'relevance', 'distance', 'rating' or 'name'.", Field: "sort"})
+			return
+		}
+		sLimit := r.URL.Query().Get("limit")
+		limit := defaultPageLimit
+		if len(sLimit) > 0 {
+			limit, err = strconv.Atoi(sLimit)
+			if err != nil || limit < 1 || limit > maxPageLimit {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: fmt.Sprintf("The parameter 'limit' must be a number between 1 and %d.", maxPageLimit), Field: "limit"})
+				return
 			}
 		}
-		// openingHours_ISO8601 := r.URL.Query().Get("filter_openingHours_ISO8601")
-		sFeatures := r.URL.Query().Get("filter_features")
-		features := make([]string, 0)
-		for _, feature := range strings.Split(sFeatures, ",") {
-			if len(feature) > 0 {
-				features = append(features, feature)
+		sPageToken := r.URL.Query().Get("pageToken")
+		offset := 0
+		if len(sPageToken) > 0 {
+			token, err := decodePageToken(sPageToken)
+			if err != nil || token.Sort != sortBy {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'pageToken' is invalid or belongs to a different sort order.", Field: "pageToken"})
+				return
 			}
+			offset = token.Offset
 		}
 
-		farmers, err := getFarmersNearBy(
+		farmers, err := app.getFarmersNearBy(
 			geoLocation{Longitude: longitude, Latitude: latitude},
 			maxDistance_km,
-			groceryTypes,
-			features,
-			// openingHours_ISO8601,
+			text,
+			tags,
+			openingHours,
+			sortBy,
 		)
 		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeInternalError(w, err)
 			return
 		}
-		b, err := json.Marshal(farmers)
+		start, end, hasMoreRecords := pageBounds(len(farmers), offset, limit)
+		// search results are cached publicly, so they never show private fields
+		page := farmers[start:end]
+		for i := range page {
+			page[i] = page[i].withoutPrivateFields()
+		}
+		b, err := json.Marshal(page)
 		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeInternalError(w, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Page-Token")
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(farmers)))
+		if hasMoreRecords {
+			w.Header().Set("X-Next-Page-Token", encodePageToken(pageToken{Offset: end, Sort: sortBy}))
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write(b)
 	})
 
-	r.HandleFunc("/api/farmers", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+	r.HandleFunc("/api/products/find", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeMethodNotAllowed(w)
+			return
+		}
 
+		sLongitude := r.URL.Query().Get("location_longitude")
+		var longitude float64
+		var err error
+		if len(sLongitude) > 0 {
+			longitude, err = strconv.ParseFloat(sLongitude, 64)
+			// written so that NaN fails the check
+			if err != nil || !(longitude >= -180 && longitude <= 180) {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'location_longitude' must be a number between -180 and 180.", Field: "location_longitude"})
+				return
+			}
+		} else {
+			writeError(w, http.StatusBadRequest, apiError{Code: errorCodeMissingParameter, Message: "The parameter 'location_longitude' is required.", Field: "location_longitude"})
+			return
+		}
+		sLatitude := r.URL.Query().Get("location_latitude")
+		var latitude float64
+		if len(sLatitude) > 0 {
+			latitude, err = strconv.ParseFloat(sLatitude, 64)
+			if err != nil || !(latitude >= -90 && latitude <= 90) {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'location_latitude' must be a number between -90 and 90.", Field: "location_latitude"})
+				return
+			}
+		} else {
+			writeError(w, http.StatusBadRequest, apiError{Code: errorCodeMissingParameter, Message: "The parameter 'location_latitude' is required.", Field: "location_latitude"})
+			return
+		}
+		sMaxDistance_km := r.URL.Query().Get("maxDistance_km")
+		var maxDistance_km float64
+		if len(sMaxDistance_km) > 0 {
+			maxDistance_km, err = strconv.ParseFloat(sMaxDistance_km, 64)
+			if err != nil || !(maxDistance_km > 0) || math.IsInf(maxDistance_km, 1) {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'maxDistance_km' must be a finite number greater than 0.", Field: "maxDistance_km"})
+				return
+			}
+		} else {
+			maxDistance_km = 50
+		}
+
+		search := productSearch{Text: r.URL.Query().Get("q")}
+		for _, name := range []string{"filter_minPrice", "filter_maxPrice"} {
+			sPrice := r.URL.Query().Get(name)
+			if len(sPrice) <= 0 {
+				continue
+			}
+			price, err := strconv.ParseFloat(sPrice, 64)
+			if err != nil || price < 0 {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter '" + name + "' must be a number that is not negative.", Field: name})
+				return
+			}
+			if name == "filter_minPrice" {
+				search.MinPrice = &price
+			} else {
+				search.MaxPrice = &price
+			}
+		}
+		search.PriceUnit = r.URL.Query().Get("filter_priceUnit")
+		if len(search.PriceUnit) > 0 && !slices.Contains(validPriceUnits, search.PriceUnit) {
+			writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'filter_priceUnit' must be one of '" + strings.Join(validPriceUnits, "', '") + "'.", Field: "filter_priceUnit"})
+			return
+		}
+
+		sortBy := r.URL.Query().Get("sort")
+		if len(sortBy) <= 0 {
+			sortBy = productSortDistance
+			if len(searchTerms(search.Text)) > 0 {
+				sortBy = productSortRelevance
+			}
+		} else if !isValidProductSort(sortBy) {
+			writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'sort' must be one of 'relevance', 'distance' or 'price'.", Field: "sort"})
+			return
+		}
+		sLimit := r.URL.Query().Get("limit")
+		limit := defaultPageLimit
+		if len(sLimit) > 0 {
+			limit, err = strconv.Atoi(sLimit)
+			if err != nil || limit < 1 || limit > maxPageLimit {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: fmt.Sprintf("The parameter 'limit' must be a number between 1 and %d.", maxPageLimit), Field: "limit"})
+				return
+			}
+		}
+		sPageToken := r.URL.Query().Get("pageToken")
+		offset := 0
+		if len(sPageToken) > 0 {
+			token, err := decodePageToken(sPageToken)
+			if err != nil || token.Sort != sortBy {
+				writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidParameter, Message: "The parameter 'pageToken' is invalid or belongs to a different sort order.", Field: "pageToken"})
+				return
+			}
+			offset = token.Offset
+		}
+
+		products, err := app.findProductsNearBy(
+			geoLocation{Longitude: longitude, Latitude: latitude},
+			maxDistance_km,
+			search,
+			sortBy,
+		)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		start, end, hasMoreRecords := pageBounds(len(products), offset, limit)
+		page := products[start:end]
+		for i := range page {
+			page[i].Farmer = page[i].Farmer.withoutPrivateFields()
+		}
+		b, err := json.Marshal(page)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Page-Token")
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(products)))
+		if hasMoreRecords {
+			w.Header().Set("X-Next-Page-Token", encodePageToken(pageToken{Offset: end, Sort: sortBy}))
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	})
+
+	r.HandleFunc("/api/farmers", requireRole([]string{roleFarmer, roleAdmin}, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			writeMethodNotAllowed(w)
 			return
 		}
 
@@ -127,68 +445,168 @@ func main() {
 
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeInternalError(w, err)
 			return
 		}
 		// deserialize farmer from request body
 		var farmer farmer
 		err = json.Unmarshal(body, &farmer)
 		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Invalid JSON"))
+			writeInvalidJson(w, err)
 			return
 		}
 
+		// farmers own what they create, admins may create farmers for others
+		// and rate them
+		claims, _ := claimsFrom(r.Context())
+		if !isAdmin(r) {
+			farmer.OwnerID = claims.Subject
+			farmer.Rating = 0
+		}
+
 		// add farmer
-		farmer, err = addFarmer(farmer)
+		farmer, err = app.addFarmer(farmer, claims.Subject)
+		if invalid, ok := err.(validationError); ok {
+			writeValidationError(w, invalid)
+			return
+		}
 		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeInternalError(w, err)
 			return
 		}
 		b, err := json.Marshal(farmer)
 		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeInternalError(w, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		w.Write(b)
-	})
+	}))
+
+	r.HandleFunc("/api/farmers/{id}", app.requireOwner(farmerOwner, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "PATCH" && r.Method != "PUT" && r.Method != "DELETE" {
+			writeMethodNotAllowed(w)
+			return
+		}
+
+		farmerId := mux.Vars(r)["id"]
+		_, err := fromJsonFarmerId(farmerId)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidId, Message: "Invalid farmer id: " + farmerId, Field: "id"})
+			return
+		}
+
+		if r.Method == "DELETE" {
+			err = app.deleteFarmer(farmerId)
+			if err == errFarmerNotFound {
+				writeError(w, http.StatusNotFound, apiError{Code: errorCodeNotFound, Message: "Farmer not found", Field: "id"})
+				return
+			}
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
 
-	r.HandleFunc("/api/farmers/{id}/products", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		var changes farmer
+		if r.Method == "PATCH" || r.Method == "PUT" {
+			defer r.Body.Close()
 
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			// deserialize farmer from request body
+			err = json.Unmarshal(body, &changes)
+			if err != nil {
+				writeInvalidJson(w, err)
+				return
+			}
+		}
+
+		// only admins may hand a farmer over to someone else or rate it
+		if !isAdmin(r) {
+			changes.OwnerID = ""
+			changes.Rating = 0
+		}
+
+		var farmer farmer
+		switch r.Method {
+		case "GET":
+			farmer, err = app.getFarmer(farmerId)
+			if err == nil && !isVisibleTo(r, farmer) {
+				err = errFarmerNotFound
+			}
+			if err == nil && !isOwnerOrAdmin(r, farmer) {
+				farmer = farmer.withoutPrivateFields()
+			}
+		case "PATCH":
+			farmer, err = app.updateFarmer(farmerId, changes)
+		case "PUT":
+			farmer, err = app.replaceFarmer(farmerId, changes)
+		}
+		if invalid, ok := err.(validationError); ok {
+			writeValidationError(w, invalid)
+			return
+		}
+		if err == errFarmerNotFound {
+			writeError(w, http.StatusNotFound, apiError{Code: errorCodeNotFound, Message: "Farmer not found", Field: "id"})
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		b, err := json.Marshal(farmer)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}))
+
+	r.HandleFunc("/api/farmers/{id}/products", app.requireOwner(farmerOwner, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" && r.Method != "GET" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			writeMethodNotAllowed(w)
 			return
 		}
 
 		// get farmer id from path
 		farmerId := strings.TrimPrefix(r.URL.Path, "/api/farmers/")
 		farmerId = strings.TrimSuffix(farmerId, "/products")
-		_, err := fromJsonFarmerId(farmerId)
+		farmerObjectId, err := fromJsonFarmerId(farmerId)
 		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Invalid farmer id"))
+			writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidId, Message: "Invalid farmer id: " + farmerId, Field: "id"})
 			return
 		}
 
 		if r.Method == "GET" {
-			products, err := getProductsByFarmer(farmerId)
+			farmer, err := app.farmers.Get(farmerObjectId)
+			if err == nil && !isVisibleTo(r, farmer) {
+				err = errFarmerNotFound
+			}
+			if err == errFarmerNotFound {
+				writeError(w, http.StatusNotFound, apiError{Code: errorCodeNotFound, Message: "Farmer not found", Field: "id"})
+				return
+			}
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			products, err := app.getProductsByFarmer(farmerId)
 			if err != nil {
-				log.Print(err)
-				w.WriteHeader(http.StatusInternalServerError)
+				writeInternalError(w, err)
 				return
 			}
 			b, err := json.Marshal(products)
 			if err != nil {
-				log.Print(err)
-				w.WriteHeader(http.StatusInternalServerError)
+				writeInternalError(w, err)
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
@@ -200,38 +618,244 @@ func main() {
 
 			body, err := ioutil.ReadAll(r.Body)
 			if err != nil {
-				log.Print(err)
-				w.WriteHeader(http.StatusInternalServerError)
+				writeInternalError(w, err)
 				return
 			}
 			// deserialize products from request body
 			var products []product
 			err = json.Unmarshal(body, &products)
 			if err != nil {
-				log.Print(err)
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte("Invalid JSON"))
+				writeInvalidJson(w, err)
 				return
 			}
 
 			// add product
-			products, err = addProducts(farmerId, products)
+			products, err = app.addProducts(farmerId, products)
+			if invalid, ok := err.(validationError); ok {
+				writeValidationError(w, invalid)
+				return
+			}
+			if err == errFarmerNotFound {
+				writeError(w, http.StatusNotFound, apiError{Code: errorCodeNotFound, Message: "Farmer not found", Field: "id"})
+				return
+			}
 			if err != nil {
-				log.Print(err)
-				w.WriteHeader(http.StatusInternalServerError)
+				writeInternalError(w, err)
 				return
 			}
 			b, err := json.Marshal(products)
 			if err != nil {
-				log.Print(err)
-				w.WriteHeader(http.StatusInternalServerError)
+				writeInternalError(w, err)
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
 			w.Write(b)
 		}
-	})
+	}))
 
-	log.Fatal(listener(portStr, r))
+	r.HandleFunc("/api/products/{id}", app.requireOwner(productOwner, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "PATCH" && r.Method != "DELETE" {
+			writeMethodNotAllowed(w)
+			return
+		}
+
+		productId := mux.Vars(r)["id"]
+		_, err := fromJsonProductId(productId)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidId, Message: "Invalid product id: " + productId, Field: "id"})
+			return
+		}
+
+		if r.Method == "DELETE" {
+			err = app.deleteProduct(productId)
+			if err == errProductNotFound {
+				writeError(w, http.StatusNotFound, apiError{Code: errorCodeNotFound, Message: "Product not found", Field: "id"})
+				return
+			}
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		var changes product
+		if r.Method == "PATCH" {
+			defer r.Body.Close()
+
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			// deserialize product from request body
+			err = json.Unmarshal(body, &changes)
+			if err != nil {
+				writeInvalidJson(w, err)
+				return
+			}
+		}
+
+		var product product
+		switch r.Method {
+		case "GET":
+			product, err = app.getProduct(productId)
+			if err == nil {
+				var farmer farmer
+				farmer, err = app.farmers.Get(product.MongoDbFarmerID)
+				if err == errFarmerNotFound || (err == nil && !isVisibleTo(r, farmer)) {
+					err = errProductNotFound
+				}
+			}
+		case "PATCH":
+			product, err = app.updateProduct(productId, changes)
+		}
+		if invalid, ok := err.(validationError); ok {
+			writeValidationError(w, invalid)
+			return
+		}
+		if err == errProductNotFound {
+			writeError(w, http.StatusNotFound, apiError{Code: errorCodeNotFound, Message: "Product not found", Field: "id"})
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		b, err := json.Marshal(product)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}))
+
+	r.HandleFunc("/api/admin/farmers/{id}/{action}", requireRole([]string{roleAdmin}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeMethodNotAllowed(w)
+			return
+		}
+
+		action := mux.Vars(r)["action"]
+		if _, ok := farmerStatusActions[action]; !ok {
+			writeError(w, http.StatusNotFound, apiError{Code: errorCodeNotFound, Message: "No such endpoint: " + r.URL.Path})
+			return
+		}
+		farmerId := mux.Vars(r)["id"]
+		_, err := fromJsonFarmerId(farmerId)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: errorCodeInvalidId, Message: "Invalid farmer id: " + farmerId, Field: "id"})
+			return
+		}
+
+		defer r.Body.Close()
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		// the body is optional and may give a reason for the change
+		var request struct {
+			Reason string `json:"reason"`
+		}
+		if len(body) > 0 {
+			err = json.Unmarshal(body, &request)
+			if err != nil {
+				writeInvalidJson(w, err)
+				return
+			}
+		}
+
+		claims, _ := claimsFrom(r.Context())
+		farmer, err := app.changeFarmerStatus(farmerId, action, claims.Subject, request.Reason)
+		if err == errFarmerNotFound {
+			writeError(w, http.StatusNotFound, apiError{Code: errorCodeNotFound, Message: "Farmer not found", Field: "id"})
+			return
+		}
+		if err == errInvalidStatusTransition {
+			writeError(w, http.StatusConflict, apiError{Code: errorCodeInvalidStatusTransition, Message: "The farmer's current status does not allow to " + action + " them."})
+			return
+		}
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		b, err := json.Marshal(farmer)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}))
+
+	r.HandleFunc("/api/admin/groceryTypes/rebuild", requireRole([]string{roleAdmin}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeMethodNotAllowed(w)
+			return
+		}
+
+		farmersUpdated, err := app.products.RebuildGroceryTypes()
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		b, err := json.Marshal(map[string]int64{"farmersUpdated": farmersUpdated})
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}))
+
+	r.HandleFunc("/api/admin/geoIndexOutbox/process", requireRole([]string{roleAdmin}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeMethodNotAllowed(w)
+			return
+		}
+
+		applied, err := app.processGeoIndexOutbox(r.Context(), nil, 100)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		b, err := json.Marshal(map[string]int{"applied": applied})
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}))
+
+	return r
+}
+
+// listenAndServeUntilDone serves HTTP on addr until ctx is done and then
+// shuts down gracefully, giving in-flight requests some time to complete.
+func listenAndServeUntilDone(ctx context.Context, addr string, handler http.Handler) error {
+	server := &http.Server{Addr: addr, Handler: handler}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	log.Print("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
 }
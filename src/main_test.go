@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testSigningKey = []byte("0123456789abcdef0123456789abcdef")
+
+// newTestServer returns the router over an app with in-memory backends.
+func newTestServer(t *testing.T) (*app, http.Handler) {
+	t.Helper()
+	app, err := newApp("memory", "memory", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.signingKey = testSigningKey
+	return app, newRouter(app, "")
+}
+
+func testToken(t *testing.T, subject string, role string) string {
+	t.Helper()
+	token, err := issueToken(testSigningKey, subject, role, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// serve sends a request with the token, if any, and body, if not nil, as
+// JSON.
+func serve(t *testing.T, handler http.Handler, method string, path string, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, path, &payload)
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("Expected status %d, got %d: %s", status, w.Code, w.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("Cannot decode %s: %s", w.Body.String(), err)
+	}
+}
+
+// errorOf decodes the error envelope of the response.
+func errorOf(t *testing.T, w *httptest.ResponseRecorder) apiError {
+	t.Helper()
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Cannot decode error %s: %s", w.Body.String(), err)
+	}
+	return body.Error
+}
+
+var testFarmer = farmer{
+	Name:     "Hof Müller",
+	Location: geoLocation{Longitude: 13.4, Latitude: 52.5},
+	Features: []string{"Hofladen"},
+	OwnerID:  "someone-else",
+	Rating:   5,
+}
+
+// addTestFarmer creates a farmer owned by the subject of the farmer token
+// and, if approve is set, approves it.
+func addTestFarmer(t *testing.T, handler http.Handler, farmerToken string, approve bool) farmer {
+	t.Helper()
+	var created farmer
+	decodeResponse(t, serve(t, handler, "POST", "/api/farmers", farmerToken, testFarmer), http.StatusOK, &created)
+	if approve {
+		adminToken := testToken(t, "admin", roleAdmin)
+		decodeResponse(t, serve(t, handler, "POST", "/api/admin/farmers/"+created.ID+"/approve", adminToken, nil), http.StatusOK, &created)
+	}
+	return created
+}
+
+func TestHealth(t *testing.T) {
+	_, handler := newTestServer(t)
+	var health map[string]string
+	decodeResponse(t, serve(t, handler, "GET", "/api/health", "", nil), http.StatusOK, &health)
+	if health["status"] != "ok" {
+		t.Errorf("Expected ok, got %v", health)
+	}
+}
+
+func TestNewAppRefusesMemoryGeoIndexOverMongoOnLambda(t *testing.T) {
+	if _, err := newApp("mongo", "memory", "", false); err == nil {
+		t.Error("Expected the memory geo index over MongoDB to be refused without -port")
+	}
+}
+
+func TestAddFarmerRequiresFarmerRole(t *testing.T) {
+	_, handler := newTestServer(t)
+	w := serve(t, handler, "POST", "/api/farmers", "", testFarmer)
+	if w.Code != http.StatusUnauthorized || errorOf(t, w).Code != errorCodeUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d: %s", w.Code, w.Body.String())
+	}
+	w = serve(t, handler, "POST", "/api/farmers", testToken(t, "shopper", roleShopper), testFarmer)
+	if w.Code != http.StatusForbidden || errorOf(t, w).Code != errorCodeForbidden {
+		t.Errorf("Expected 403 for a shopper, got %d: %s", w.Code, w.Body.String())
+	}
+	w = serve(t, handler, "POST", "/api/farmers", "not-a-token", testFarmer)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a malformed token, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAddFarmer(t *testing.T) {
+	_, handler := newTestServer(t)
+	created := addTestFarmer(t, handler, testToken(t, "anna", roleFarmer), false)
+	if len(created.ID) <= 0 || created.Status != farmerStatusPending {
+		t.Errorf("Expected a pending farmer with an id, got %+v", created)
+	}
+	// farmers own what they create and cannot rate themselves
+	if created.OwnerID != "anna" || created.Rating != 0 {
+		t.Errorf("Expected the farmer to be owned by anna without rating, got %s, %g", created.OwnerID, created.Rating)
+	}
+	if len(created.Features) != 1 || created.Features[0] != "farm-shop" {
+		t.Errorf("Expected the feature to be normalized, got %v", created.Features)
+	}
+}
+
+func TestAddFarmerValidationFailed(t *testing.T) {
+	_, handler := newTestServer(t)
+	invalid := farmer{Location: geoLocation{Longitude: 200, Latitude: 52.5}, Features: []string{"unicorns"}}
+	w := serve(t, handler, "POST", "/api/farmers", testToken(t, "anna", roleFarmer), invalid)
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	decodeResponse(t, w, http.StatusUnprocessableEntity, &body)
+	if body.Error.Code != errorCodeValidationFailed {
+		t.Errorf("Expected %s, got %s", errorCodeValidationFailed, body.Error.Code)
+	}
+	fields := make(map[string]string)
+	for _, violation := range body.Error.Details {
+		fields[violation.Field] = violation.Code
+	}
+	want := map[string]string{
+		"name":               errorCodeMissingField,
+		"location.longitude": errorCodeInvalidField,
+		"features[0]":        errorCodeInvalidField,
+	}
+	for field, code := range want {
+		if fields[field] != code {
+			t.Errorf("Expected %s for %s, got %v", code, field, body.Error.Details)
+		}
+	}
+}
+
+func TestPendingFarmerIsHidden(t *testing.T) {
+	_, handler := newTestServer(t)
+	ownerToken := testToken(t, "anna", roleFarmer)
+	created := addTestFarmer(t, handler, ownerToken, false)
+
+	w := serve(t, handler, "GET", "/api/farmers/"+created.ID, "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected the pending farmer to be hidden, got %d", w.Code)
+	}
+	w = serve(t, handler, "GET", "/api/farmers/"+created.ID, testToken(t, "bert", roleFarmer), nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected the pending farmer to be hidden from other farmers, got %d", w.Code)
+	}
+	var own farmer
+	decodeResponse(t, serve(t, handler, "GET", "/api/farmers/"+created.ID, ownerToken, nil), http.StatusOK, &own)
+	if own.OwnerID != "anna" || len(own.StatusHistory) != 1 {
+		t.Errorf("Expected the owner to see private fields, got %+v", own)
+	}
+
+	var found []farmer
+	decodeResponse(t, serve(t, handler, "GET", "/api/farmers/find?location_longitude=13.4&location_latitude=52.5", "", nil), http.StatusOK, &found)
+	if len(found) != 0 {
+		t.Errorf("Expected no farmers to be found, got %v", found)
+	}
+}
+
+func TestApprovedFarmerIsShown(t *testing.T) {
+	_, handler := newTestServer(t)
+	created := addTestFarmer(t, handler, testToken(t, "anna", roleFarmer), true)
+	if created.Status != farmerStatusVerified || len(created.StatusHistory) != 2 {
+		t.Fatalf("Expected the farmer to be verified, got %+v", created)
+	}
+
+	var public farmer
+	decodeResponse(t, serve(t, handler, "GET", "/api/farmers/"+created.ID, "", nil), http.StatusOK, &public)
+	if public.Name != testFarmer.Name || len(public.OwnerID) > 0 || len(public.StatusHistory) > 0 {
+		t.Errorf("Expected the farmer without private fields, got %+v", public)
+	}
+}
+
+func TestFindFarmers(t *testing.T) {
+	_, handler := newTestServer(t)
+	created := addTestFarmer(t, handler, testToken(t, "anna", roleFarmer), true)
+
+	w := serve(t, handler, "GET", "/api/farmers/find?location_longitude=13.41&location_latitude=52.51&q=muller", "", nil)
+	var found []farmer
+	decodeResponse(t, w, http.StatusOK, &found)
+	if len(found) != 1 || found[0].ID != created.ID {
+		t.Fatalf("Expected the farmer to be found, got %v", found)
+	}
+	if len(found[0].OwnerID) > 0 || len(found[0].StatusHistory) > 0 {
+		t.Errorf("Expected search results without private fields, got %+v", found[0])
+	}
+	if w.Header().Get("X-Total-Count") != "1" {
+		t.Errorf("Expected X-Total-Count 1, got %s", w.Header().Get("X-Total-Count"))
+	}
+
+	decodeResponse(t, serve(t, handler, "GET", "/api/farmers/find?location_longitude=13.4&location_latitude=52.5&filter_features=Bio", "", nil), http.StatusOK, &found)
+	if len(found) != 0 {
+		t.Errorf("Expected the missing feature to filter the farmer out, got %v", found)
+	}
+	decodeResponse(t, serve(t, handler, "GET", "/api/farmers/find?location_longitude=13.4&location_latitude=52.5&filter_features_none=farm-shop", "", nil), http.StatusOK, &found)
+	if len(found) != 0 {
+		t.Errorf("Expected the excluded feature to filter the farmer out, got %v", found)
+	}
+	decodeResponse(t, serve(t, handler, "GET", "/api/farmers/find?location_longitude=13.4&location_latitude=52.5&q=schulz", "", nil), http.StatusOK, &found)
+	if len(found) != 0 {
+		t.Errorf("Expected the text to filter the farmer out, got %v", found)
+	}
+}
+
+func TestFindFarmersInvalidParameter(t *testing.T) {
+	_, handler := newTestServer(t)
+	tests := []struct {
+		query string
+		code  string
+		field string
+	}{
+		{"location_latitude=52.5", errorCodeMissingParameter, "location_longitude"},
+		{"location_longitude=east&location_latitude=52.5", errorCodeInvalidParameter, "location_longitude"},
+		{"location_longitude=13.4&location_latitude=52.5&limit=0", errorCodeInvalidParameter, "limit"},
+		{"location_longitude=13.4&location_latitude=52.5&sort=price", errorCodeInvalidParameter, "sort"},
+		{"location_longitude=13.4&location_latitude=52.5&pageToken=nonsense", errorCodeInvalidParameter, "pageToken"},
+	}
+	for _, test := range tests {
+		w := serve(t, handler, "GET", "/api/farmers/find?"+test.query, "", nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", test.query, w.Code, w.Body.String())
+			continue
+		}
+		if apiErr := errorOf(t, w); apiErr.Code != test.code || apiErr.Field != test.field {
+			t.Errorf("%s: expected %s for %s, got %+v", test.query, test.code, test.field, apiErr)
+		}
+	}
+}
+
+func TestFindInvalidLocation(t *testing.T) {
+	_, handler := newTestServer(t)
+	tests := []struct {
+		query string
+		field string
+	}{
+		{"location_longitude=180.5&location_latitude=52.5", "location_longitude"},
+		{"location_longitude=-181&location_latitude=52.5", "location_longitude"},
+		{"location_longitude=NaN&location_latitude=52.5", "location_longitude"},
+		{"location_longitude=Inf&location_latitude=52.5", "location_longitude"},
+		{"location_longitude=13.4&location_latitude=90.5", "location_latitude"},
+		{"location_longitude=13.4&location_latitude=-Inf", "location_latitude"},
+		{"location_longitude=13.4&location_latitude=nan", "location_latitude"},
+		{"location_longitude=13.4&location_latitude=52.5&maxDistance_km=0", "maxDistance_km"},
+		{"location_longitude=13.4&location_latitude=52.5&maxDistance_km=-5", "maxDistance_km"},
+		{"location_longitude=13.4&location_latitude=52.5&maxDistance_km=NaN", "maxDistance_km"},
+		{"location_longitude=13.4&location_latitude=52.5&maxDistance_km=+Inf", "maxDistance_km"},
+	}
+	for _, path := range []string{"/api/farmers/find", "/api/products/find"} {
+		for _, test := range tests {
+			w := serve(t, handler, "GET", path+"?"+test.query, "", nil)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s?%s: expected 400, got %d: %s", path, test.query, w.Code, w.Body.String())
+				continue
+			}
+			if apiErr := errorOf(t, w); apiErr.Code != errorCodeInvalidParameter || apiErr.Field != test.field {
+				t.Errorf("%s?%s: expected %s for %s, got %+v", path, test.query, errorCodeInvalidParameter, test.field, apiErr)
+			}
+		}
+		// the bounds themselves are valid
+		w := serve(t, handler, "GET", path+"?location_longitude=-180&location_latitude=90&maxDistance_km=0.5", "", nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected 200 for coordinates on the bounds, got %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestUnknownFarmer(t *testing.T) {
+	_, handler := newTestServer(t)
+	w := serve(t, handler, "GET", "/api/farmers/f-000000000000000000000000", "", nil)
+	if w.Code != http.StatusNotFound || errorOf(t, w).Code != errorCodeNotFound {
+		t.Errorf("Expected 404 %s, got %d: %s", errorCodeNotFound, w.Code, w.Body.String())
+	}
+	w = serve(t, handler, "GET", "/api/farmers/nonsense", "", nil)
+	if w.Code != http.StatusBadRequest || errorOf(t, w).Code != errorCodeInvalidId {
+		t.Errorf("Expected 400 %s, got %d: %s", errorCodeInvalidId, w.Code, w.Body.String())
+	}
+}
+
+func TestUpdateFarmerRequiresOwner(t *testing.T) {
+	_, handler := newTestServer(t)
+	created := addTestFarmer(t, handler, testToken(t, "anna", roleFarmer), true)
+	changes := farmer{Name: "Hof Schulz", Rating: 5}
+
+	w := serve(t, handler, "PATCH", "/api/farmers/"+created.ID, testToken(t, "bert", roleFarmer), changes)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for another farmer, got %d", w.Code)
+	}
+
+	var updated farmer
+	decodeResponse(t, serve(t, handler, "PATCH", "/api/farmers/"+created.ID, testToken(t, "anna", roleFarmer), changes), http.StatusOK, &updated)
+	if updated.Name != "Hof Schulz" || updated.Rating != 0 {
+		t.Errorf("Expected the name to change but not the rating, got %s, %g", updated.Name, updated.Rating)
+	}
+
+	adminToken := testToken(t, "admin", roleAdmin)
+	decodeResponse(t, serve(t, handler, "PATCH", "/api/farmers/"+created.ID, adminToken, farmer{Rating: 4}), http.StatusOK, &updated)
+	if updated.Rating != 4 {
+		t.Errorf("Expected admins to rate farmers, got %g", updated.Rating)
+	}
+
+	// replacing by the owner keeps the rating
+	replacement := testFarmer
+	replacement.Rating = 1
+	decodeResponse(t, serve(t, handler, "PUT", "/api/farmers/"+created.ID, testToken(t, "anna", roleFarmer), replacement), http.StatusOK, &updated)
+	if updated.Rating != 4 || updated.OwnerID != "anna" || updated.Status != farmerStatusVerified {
+		t.Errorf("Expected the rating, owner and status to be kept, got %g, %s, %s", updated.Rating, updated.OwnerID, updated.Status)
+	}
+}
+
+func TestChangeFarmerStatus(t *testing.T) {
+	_, handler := newTestServer(t)
+	created := addTestFarmer(t, handler, testToken(t, "anna", roleFarmer), false)
+	adminToken := testToken(t, "admin", roleAdmin)
+
+	w := serve(t, handler, "POST", "/api/admin/farmers/"+created.ID+"/approve", testToken(t, "anna", roleFarmer), nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected farmers not to approve themselves, got %d", w.Code)
+	}
+
+	var archived farmer
+	decodeResponse(t, serve(t, handler, "POST", "/api/admin/farmers/"+created.ID+"/archive", adminToken, map[string]string{"reason": "closed"}), http.StatusOK, &archived)
+	last := archived.StatusHistory[len(archived.StatusHistory)-1]
+	if archived.Status != farmerStatusArchived || last.Reason != "closed" || last.ChangedBy != "admin" {
+		t.Errorf("Expected the farmer to be archived by admin, got %+v", archived)
+	}
+
+	w = serve(t, handler, "POST", "/api/admin/farmers/"+created.ID+"/approve", adminToken, nil)
+	if w.Code != http.StatusConflict || errorOf(t, w).Code != errorCodeInvalidStatusTransition {
+		t.Errorf("Expected 409 when approving an archived farmer, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = serve(t, handler, "POST", "/api/admin/farmers/"+created.ID+"/promote", adminToken, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown action, got %d", w.Code)
+	}
+}
+
+func TestProducts(t *testing.T) {
+	app, handler := newTestServer(t)
+	ownerToken := testToken(t, "anna", roleFarmer)
+	created := addTestFarmer(t, handler, ownerToken, false)
+	products := []product{
+		{Name: "Ziegenkäse", GroceryType: "goat cheese", Price: price{Value: 4.5, PerUnit: "piece"}},
+		{Name: "Tomaten", GroceryType: "Tomaten", Price: price{Value: 3, PerUnit: "kg"}},
+	}
+	w := serve(t, handler, "POST", "/api/farmers/"+created.ID+"/products", testToken(t, "bert", roleFarmer), products)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for another farmer, got %d", w.Code)
+	}
+	var added []product
+	decodeResponse(t, serve(t, handler, "POST", "/api/farmers/"+created.ID+"/products", ownerToken, products), http.StatusOK, &added)
+	if len(added) != 2 || len(added[0].ID) <= 0 || added[0].FarmerID != created.ID {
+		t.Fatalf("Expected the products with ids, got %+v", added)
+	}
+	if added[0].GroceryType != "goat-cheese" || added[1].GroceryType != "tomatoes" {
+		t.Errorf("Expected the grocery types to be normalized, got %s, %s", added[0].GroceryType, added[1].GroceryType)
+	}
+
+	// the products of pending farmers are hidden
+	w = serve(t, handler, "GET", "/api/farmers/"+created.ID+"/products", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected the products of a pending farmer to be hidden, got %d", w.Code)
+	}
+	w = serve(t, handler, "GET", "/api/products/"+added[0].ID, "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected the product of a pending farmer to be hidden, got %d", w.Code)
+	}
+	decodeResponse(t, serve(t, handler, "GET", "/api/products/"+added[0].ID, ownerToken, nil), http.StatusOK, nil)
+
+	adminToken := testToken(t, "admin", roleAdmin)
+	decodeResponse(t, serve(t, handler, "POST", "/api/admin/farmers/"+created.ID+"/approve", adminToken, nil), http.StatusOK, nil)
+	var listed []product
+	decodeResponse(t, serve(t, handler, "GET", "/api/farmers/"+created.ID+"/products", "", nil), http.StatusOK, &listed)
+	if len(listed) != 2 {
+		t.Errorf("Expected 2 products, got %+v", listed)
+	}
+
+	// the grocery types of the farmer follow its products
+	farmerObjectId, err := fromJsonFarmerId(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := app.farmers.Get(farmerObjectId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated.GroceryTypes) != 2 {
+		t.Errorf("Expected the grocery types of both products, got %v", updated.GroceryTypes)
+	}
+
+	w = serve(t, handler, "DELETE", "/api/products/"+added[0].ID, "", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", w.Code)
+	}
+	// the farmer's grocery types follow their products
+	var found []farmer
+	decodeResponse(t, serve(t, handler, "GET", "/api/farmers/find?location_longitude=13.4&location_latitude=52.5&filter_groceryTypes=cheese", "", nil), http.StatusOK, &found)
+	if len(found) != 1 || len(found[0].MatchedGroceryTypes) != 1 || found[0].MatchedGroceryTypes[0].Filter != "cheese" {
+		t.Errorf("Expected the farmer to match cheese through goat cheese, got %+v", found)
+	}
+
+	decodeResponse(t, serve(t, handler, "DELETE", "/api/products/"+added[0].ID, ownerToken, nil), http.StatusNoContent, nil)
+	decodeResponse(t, serve(t, handler, "GET", "/api/farmers/"+created.ID+"/products", "", nil), http.StatusOK, &listed)
+	if len(listed) != 1 || listed[0].ID != added[1].ID {
+		t.Errorf("Expected only the remaining product, got %+v", listed)
+	}
+}
+
+func TestAddProductsForUnknownFarmer(t *testing.T) {
+	app, handler := newTestServer(t)
+	products := []product{{Name: "Tomaten", GroceryType: "Gemüse", Price: price{Value: 3, PerUnit: "kg"}}}
+	w := serve(t, handler, "POST", "/api/farmers/f-000000000000000000000000/products", testToken(t, "admin", roleAdmin), products)
+	if w.Code != http.StatusNotFound || errorOf(t, w).Code != errorCodeNotFound {
+		t.Errorf("Expected 404 %s, got %d: %s", errorCodeNotFound, w.Code, w.Body.String())
+	}
+	// nothing is stored for the unknown farmer
+	store := app.outbox.(memoryGeoIndexOutbox).store
+	if len(store.products) != 0 {
+		t.Errorf("Expected no products to be stored, got %d", len(store.products))
+	}
+}
+
+func TestCors(t *testing.T) {
+	_, handler := newTestServer(t)
+	r := httptest.NewRequest("GET", "/api/health", nil)
+	r.Header.Set("Origin", "https://example.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); len(origin) > 0 {
+		t.Errorf("Expected cross-origin requests to be refused by default, got %s", origin)
+	}
+
+	app, _ := newTestServer(t)
+	handler = newRouter(app, "https://shop.example.com")
+	for origin, want := range map[string]string{"https://shop.example.com": "https://shop.example.com", "https://example.com": ""} {
+		r := httptest.NewRequest("OPTIONS", "/api/farmers", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != want {
+			t.Errorf("%s: expected %d with origin %q, got %d with %q", origin, http.StatusNoContent, want, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+}
+
+func TestAddFarmerGeocodesAddress(t *testing.T) {
+	_, handler := newTestServer(t)
+	withAddress := testFarmer
+	withAddress.Location = geoLocation{}
+	withAddress.Address = address{ZipCode: "14467", City: "Potsdam", Country: "DE"}
+	var created farmer
+	decodeResponse(t, serve(t, handler, "POST", "/api/farmers", testToken(t, "anna", roleFarmer), withAddress), http.StatusOK, &created)
+	if created.Location != (geoLocation{Longitude: 13.0657, Latitude: 52.3989}) {
+		t.Errorf("Expected the location of Potsdam, got %+v", created.Location)
+	}
+
+	withAddress.Address = address{ZipCode: "99999", Country: "DE"}
+	w := serve(t, handler, "POST", "/api/farmers", testToken(t, "anna", roleFarmer), withAddress)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected an unknown address to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestUpdateFarmerGeocodesAddress(t *testing.T) {
+	_, handler := newTestServer(t)
+	token := testToken(t, "anna", roleFarmer)
+	created := addTestFarmer(t, handler, token, true)
+	potsdam := geoLocation{Longitude: 13.0657, Latitude: 52.3989}
+
+	var updated farmer
+	changes := farmer{Address: address{ZipCode: "14467", City: "Potsdam", Country: "DE"}}
+	decodeResponse(t, serve(t, handler, "PATCH", "/api/farmers/"+created.ID, token, changes), http.StatusOK, &updated)
+	if updated.Location != potsdam {
+		t.Errorf("Expected a PATCH of the address to move the farmer to Potsdam, got %+v", updated.Location)
+	}
+	var found []farmer
+	decodeResponse(t, serve(t, handler, "GET", "/api/farmers/find?location_longitude=13.0657&location_latitude=52.3989&maxDistance_km=1", "", nil), http.StatusOK, &found)
+	if len(found) != 1 || found[0].ID != created.ID {
+		t.Errorf("Expected the farmer to be found in Potsdam, got %+v", found)
+	}
+
+	// a PATCH that only repeats the address keeps an explicitly set location
+	decodeResponse(t, serve(t, handler, "PATCH", "/api/farmers/"+created.ID, token, farmer{Location: testFarmer.Location}), http.StatusOK, nil)
+	decodeResponse(t, serve(t, handler, "PATCH", "/api/farmers/"+created.ID, token, farmer{Address: address{City: "Potsdam"}}), http.StatusOK, &updated)
+	if updated.Location != testFarmer.Location {
+		t.Errorf("Expected an unchanged address to keep the location, got %+v", updated.Location)
+	}
+
+	replacement := testFarmer
+	replacement.Location = geoLocation{}
+	replacement.Address = address{ZipCode: "10115", City: "Berlin", Country: "DE"}
+	decodeResponse(t, serve(t, handler, "PUT", "/api/farmers/"+created.ID, token, replacement), http.StatusOK, &updated)
+	if updated.Location != (geoLocation{Longitude: 13.3846, Latitude: 52.5323}) {
+		t.Errorf("Expected a PUT with an address to locate the farmer in Berlin, got %+v", updated.Location)
+	}
+
+	changes.Address = address{ZipCode: "99999", Country: "DE"}
+	w := serve(t, handler, "PATCH", "/api/farmers/"+created.ID, token, changes)
+	if w.Code != http.StatusUnprocessableEntity || errorOf(t, w).Code != errorCodeValidationFailed {
+		t.Errorf("Expected an unknown address to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestFindProducts(t *testing.T) {
+	_, handler := newTestServer(t)
+	approvedToken := testToken(t, "anna", roleFarmer)
+	approved := addTestFarmer(t, handler, approvedToken, true)
+	pendingToken := testToken(t, "bert", roleFarmer)
+	pending := addTestFarmer(t, handler, pendingToken, false)
+	honey := []product{{Name: "Blütenhonig", GroceryType: "honey", Price: price{Value: 6, PerUnit: "piece"}}}
+	decodeResponse(t, serve(t, handler, "POST", "/api/farmers/"+approved.ID+"/products", approvedToken, honey), http.StatusOK, nil)
+	decodeResponse(t, serve(t, handler, "POST", "/api/farmers/"+pending.ID+"/products", pendingToken, honey), http.StatusOK, nil)
+
+	var found []productSearchResult
+	decodeResponse(t, serve(t, handler, "GET", "/api/products/find?location_longitude=13.4&location_latitude=52.5&q=bl%C3%BCten", "", nil), http.StatusOK, &found)
+	if len(found) != 1 || found[0].FarmerID != approved.ID {
+		t.Fatalf("Expected only the product of the approved farmer, got %+v", found)
+	}
+	if len(found[0].Farmer.OwnerID) > 0 || len(found[0].Farmer.StatusHistory) > 0 {
+		t.Errorf("Expected the farmer without private fields, got %+v", found[0].Farmer)
+	}
+
+	// typos and missing diacritics are tolerated like in the farmer search
+	decodeResponse(t, serve(t, handler, "GET", "/api/products/find?location_longitude=13.4&location_latitude=52.5&q=blutenhonik", "", nil), http.StatusOK, &found)
+	if len(found) != 1 || found[0].Name != "Blütenhonig" {
+		t.Errorf("Expected the honey despite the typo, got %+v", found)
+	}
+	decodeResponse(t, serve(t, handler, "GET", "/api/products/find?location_longitude=13.4&location_latitude=52.5&q=honig+k%C3%A4se", "", nil), http.StatusOK, &found)
+	if len(found) != 0 {
+		t.Errorf("Expected every term to have to match, got %+v", found)
+	}
+
+	decodeResponse(t, serve(t, handler, "GET", "/api/products/find?location_longitude=13.4&location_latitude=52.5&filter_maxPrice=5", "", nil), http.StatusOK, &found)
+	if len(found) != 0 {
+		t.Errorf("Expected the price filter to exclude the honey, got %+v", found)
+	}
+	w := serve(t, handler, "GET", "/api/products/find?location_longitude=13.4&location_latitude=52.5&filter_priceUnit=jar", "", nil)
+	if w.Code != http.StatusBadRequest || errorOf(t, w).Code != errorCodeInvalidParameter {
+		t.Errorf("Expected 400 for an unknown price unit, got %d: %s", w.Code, w.Body.String())
+	}
+}
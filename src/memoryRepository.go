@@ -0,0 +1,505 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slices"
+)
+
+// memoryStore keeps farmers, products and the geo index outbox in memory. It
+// behaves like the MongoDB collections as far as the app is concerned and is
+// meant for tests and local development; nothing is persisted.
+type memoryStore struct {
+	mutex    sync.Mutex
+	farmers  map[primitive.ObjectID]farmer
+	products map[primitive.ObjectID]product
+	outbox   map[primitive.ObjectID]geoIndexOutboxEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		farmers:  make(map[primitive.ObjectID]farmer),
+		products: make(map[primitive.ObjectID]product),
+		outbox:   make(map[primitive.ObjectID]geoIndexOutboxEntry),
+	}
+}
+
+// newMemoryApp returns an app whose repositories share one memoryStore.
+func newMemoryApp(geoIndex GeoIndex) *app {
+	store := newMemoryStore()
+	return &app{
+		farmers:  memoryFarmerRepository{store},
+		products: memoryProductRepository{store},
+		outbox:   memoryGeoIndexOutbox{store},
+		geoIndex: geoIndex,
+	}
+}
+
+// enqueueGeoIndexWrite is the in-memory counterpart of the package level
+// function of the same name; the caller must hold the mutex.
+func (store *memoryStore) enqueueGeoIndexWrite(farmerObjectId primitive.ObjectID, operation string, location geoLocation) {
+	now := time.Now()
+	store.outbox[farmerObjectId] = geoIndexOutboxEntry{
+		FarmerID:      farmerObjectId,
+		Version:       primitive.NewObjectID(),
+		Operation:     operation,
+		Location:      location,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+}
+
+// recomputeFarmerGroceryTypes is the in-memory counterpart of the package
+// level function of the same name; the caller must hold the mutex.
+func (store *memoryStore) recomputeFarmerGroceryTypes(farmerObjectId primitive.ObjectID) {
+	farmer, ok := store.farmers[farmerObjectId]
+	if !ok {
+		return
+	}
+	groceryTypes := make([]string, 0)
+	for _, product := range store.products {
+		if product.MongoDbFarmerID == farmerObjectId && len(product.GroceryType) > 0 &&
+			!slices.Contains(groceryTypes, product.GroceryType) {
+			groceryTypes = append(groceryTypes, product.GroceryType)
+		}
+	}
+	sort.Strings(groceryTypes)
+	farmer.GroceryTypes = groceryTypes
+	store.farmers[farmerObjectId] = farmer
+}
+
+// applyMongoPatch applies a $set document as built by toMongoPatch to value
+// and decodes the result into out, so that patches behave exactly like they
+// do in MongoDB.
+func applyMongoPatch(value interface{}, patch bson.D, out interface{}) error {
+	b, err := bson.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var document bson.M
+	if err := bson.Unmarshal(b, &document); err != nil {
+		return err
+	}
+	for _, element := range patch {
+		path := strings.Split(element.Key, ".")
+		parent := document
+		for _, key := range path[:len(path)-1] {
+			child, ok := parent[key].(bson.M)
+			if !ok {
+				child = bson.M{}
+				parent[key] = child
+			}
+			parent = child
+		}
+		parent[path[len(path)-1]] = element.Value
+	}
+	b, err = bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(b, out)
+}
+
+type memoryFarmerRepository struct {
+	store *memoryStore
+}
+
+func (repository memoryFarmerRepository) FindByIDs(ids []string, tags farmerFilter) ([]farmer, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	results := make([]farmer, 0)
+	for _, id := range ids {
+		objectId, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, err
+		}
+		farmer, ok := store.farmers[objectId]
+		if !ok || !farmer.isVerified() || !tags.matches(farmer) {
+			continue
+		}
+		results = append(results, farmer)
+	}
+	return results, nil
+}
+
+func (repository memoryFarmerRepository) FindNearBy(point geoLocation, maxDistance_km float64, tags farmerFilter) ([]farmer, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	candidates := make([]farmer, 0)
+	for _, farmer := range store.farmers {
+		if farmer.isVerified() && tags.matches(farmer) {
+			candidates = append(candidates, farmer)
+		}
+	}
+	return withinDistance(candidates, point, maxDistance_km), nil
+}
+
+func (repository memoryFarmerRepository) Get(farmerObjectId primitive.ObjectID) (farmer, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	farmer, ok := store.farmers[farmerObjectId]
+	if !ok {
+		return farmer, errFarmerNotFound
+	}
+	return farmer, nil
+}
+
+func (repository memoryFarmerRepository) Insert(farmer farmer) (farmer, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	farmer.MongoDbID = primitive.NewObjectID()
+	store.farmers[farmer.MongoDbID] = farmer
+	if farmer.isVerified() {
+		store.enqueueGeoIndexWrite(farmer.MongoDbID, geoIndexOutboxUpsert, farmer.Location)
+	}
+	return farmer, nil
+}
+
+func (repository memoryFarmerRepository) Update(farmerObjectId primitive.ObjectID, changes farmer) (farmer, error) {
+	patch, err := toMongoPatch(changes, farmerPatchSubdocuments)
+	if err != nil {
+		return farmer{}, err
+	}
+
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	existing, ok := store.farmers[farmerObjectId]
+	if !ok {
+		return farmer{}, errFarmerNotFound
+	}
+	var result farmer
+	if err := applyMongoPatch(existing, patch, &result); err != nil {
+		return farmer{}, err
+	}
+	store.farmers[farmerObjectId] = result
+	if changes.Location != (geoLocation{}) && result.isVerified() {
+		store.enqueueGeoIndexWrite(farmerObjectId, geoIndexOutboxUpsert, result.Location)
+	}
+	return result, nil
+}
+
+func (repository memoryFarmerRepository) Replace(farmer farmer) error {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.farmers[farmer.MongoDbID]; !ok {
+		return errFarmerNotFound
+	}
+	store.farmers[farmer.MongoDbID] = farmer
+	store.enqueueGeoIndexWrite(farmer.MongoDbID, geoIndexOperationFor(farmer), farmer.Location)
+	return nil
+}
+
+func (repository memoryFarmerRepository) Delete(farmerObjectId primitive.ObjectID) error {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.farmers[farmerObjectId]; !ok {
+		return errFarmerNotFound
+	}
+	delete(store.farmers, farmerObjectId)
+	// a farmer's products are of no use without the farmer
+	for id, product := range store.products {
+		if product.MongoDbFarmerID == farmerObjectId {
+			delete(store.products, id)
+		}
+	}
+	store.enqueueGeoIndexWrite(farmerObjectId, geoIndexOutboxDelete, geoLocation{})
+	return nil
+}
+
+func (repository memoryFarmerRepository) SetStatus(farmerObjectId primitive.ObjectID, from []string, change farmerStatusChange) (farmer, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	farmer, ok := store.farmers[farmerObjectId]
+	if !ok {
+		return farmer, errFarmerNotFound
+	}
+	if !slices.Contains(from, farmer.statusOrVerified()) {
+		return farmer, errInvalidStatusTransition
+	}
+	farmer.Status = change.Status
+	// copy, so that farmers returned earlier keep their history
+	farmer.StatusHistory = append(append([]farmerStatusChange{}, farmer.StatusHistory...), change)
+	store.farmers[farmerObjectId] = farmer
+	store.enqueueGeoIndexWrite(farmerObjectId, geoIndexOperationFor(farmer), farmer.Location)
+	return farmer, nil
+}
+
+func (repository memoryFarmerRepository) Locations() (map[string]geoLocation, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	locations := make(map[string]geoLocation, len(store.farmers))
+	for id, farmer := range store.farmers {
+		if farmer.isVerified() {
+			locations[id.Hex()] = farmer.Location
+		}
+	}
+	return locations, nil
+}
+
+func (repository memoryFarmerRepository) Features() (map[primitive.ObjectID][]string, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	features := make(map[primitive.ObjectID][]string)
+	for id, farmer := range store.farmers {
+		if len(farmer.Features) > 0 {
+			features[id] = slices.Clone(farmer.Features)
+		}
+	}
+	return features, nil
+}
+
+type memoryProductRepository struct {
+	store *memoryStore
+}
+
+func (repository memoryProductRepository) ByFarmer(farmerObjectId primitive.ObjectID) ([]product, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	results := make([]product, 0)
+	for _, product := range store.products {
+		if product.MongoDbFarmerID == farmerObjectId {
+			results = append(results, product)
+		}
+	}
+	// MongoDB returns products in insertion order, which ObjectIDs follow
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].MongoDbID.Hex() < results[j].MongoDbID.Hex()
+	})
+	return results, nil
+}
+
+func (repository memoryProductRepository) Get(productObjectId primitive.ObjectID) (product, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	product, ok := store.products[productObjectId]
+	if !ok {
+		return product, errProductNotFound
+	}
+	return product, nil
+}
+
+func (repository memoryProductRepository) Insert(farmerObjectId primitive.ObjectID, products []product) ([]product, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.farmers[farmerObjectId]; !ok {
+		return products, errFarmerNotFound
+	}
+	for i := range products {
+		products[i].MongoDbID = primitive.NewObjectID()
+		products[i].MongoDbFarmerID = farmerObjectId
+		store.products[products[i].MongoDbID] = products[i]
+	}
+	store.recomputeFarmerGroceryTypes(farmerObjectId)
+	return products, nil
+}
+
+func (repository memoryProductRepository) Update(productObjectId primitive.ObjectID, changes product) (product, error) {
+	patch, err := toMongoPatch(changes, productPatchSubdocuments)
+	if err != nil {
+		return product{}, err
+	}
+
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	existing, ok := store.products[productObjectId]
+	if !ok {
+		return product{}, errProductNotFound
+	}
+	var result product
+	if err := applyMongoPatch(existing, patch, &result); err != nil {
+		return product{}, err
+	}
+	store.products[productObjectId] = result
+	if len(changes.GroceryType) > 0 {
+		store.recomputeFarmerGroceryTypes(result.MongoDbFarmerID)
+	}
+	return result, nil
+}
+
+func (repository memoryProductRepository) Delete(productObjectId primitive.ObjectID) error {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	deleted, ok := store.products[productObjectId]
+	if !ok {
+		return errProductNotFound
+	}
+	delete(store.products, productObjectId)
+	store.recomputeFarmerGroceryTypes(deleted.MongoDbFarmerID)
+	return nil
+}
+
+func (repository memoryProductRepository) RebuildGroceryTypes() (int64, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var farmersUpdated int64
+	for id, farmer := range store.farmers {
+		store.recomputeFarmerGroceryTypes(id)
+		if !slices.Equal(farmer.GroceryTypes, store.farmers[id].GroceryTypes) {
+			farmersUpdated++
+		}
+	}
+	return farmersUpdated, nil
+}
+
+func (repository memoryProductRepository) GroceryTypes() (map[string]int64, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	counts := make(map[string]int64)
+	for _, product := range store.products {
+		if len(product.GroceryType) > 0 {
+			counts[product.GroceryType]++
+		}
+	}
+	return counts, nil
+}
+
+func (repository memoryProductRepository) RenameGroceryType(from string, to string) (int64, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var productsUpdated int64
+	for id, product := range store.products {
+		if product.GroceryType == from {
+			product.GroceryType = to
+			store.products[id] = product
+			productsUpdated++
+		}
+	}
+	return productsUpdated, nil
+}
+
+func (repository memoryProductRepository) Search(farmerObjectIds []primitive.ObjectID, search productSearch) ([]productSearchResult, error) {
+	store := repository.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	results := make([]productSearchResult, 0)
+	for _, product := range store.products {
+		if !slices.Contains(farmerObjectIds, product.MongoDbFarmerID) {
+			continue
+		}
+		if !search.matchesPrice(product.Price) {
+			continue
+		}
+		results = append(results, productSearchResult{product: product})
+	}
+	return results, nil
+}
+
+type memoryGeoIndexOutbox struct {
+	store *memoryStore
+}
+
+func (outbox memoryGeoIndexOutbox) Due(farmerObjectId *primitive.ObjectID, now time.Time, limit int) ([]geoIndexOutboxEntry, error) {
+	store := outbox.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entries := make([]geoIndexOutboxEntry, 0)
+	for id, entry := range store.outbox {
+		if entry.NextAttemptAt.After(now) || (farmerObjectId != nil && id != *farmerObjectId) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].NextAttemptAt.Before(entries[j].NextAttemptAt)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (outbox memoryGeoIndexOutbox) Claim(entry geoIndexOutboxEntry, now time.Time, until time.Time) (bool, error) {
+	store := outbox.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current, ok := store.outbox[entry.FarmerID]
+	if !ok || current.Version != entry.Version || current.NextAttemptAt.After(now) {
+		return false, nil
+	}
+	current.NextAttemptAt = until
+	store.outbox[entry.FarmerID] = current
+	return true, nil
+}
+
+func (outbox memoryGeoIndexOutbox) Complete(entry geoIndexOutboxEntry) error {
+	store := outbox.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if current, ok := store.outbox[entry.FarmerID]; ok && current.Version == entry.Version {
+		delete(store.outbox, entry.FarmerID)
+	}
+	return nil
+}
+
+func (outbox memoryGeoIndexOutbox) Retry(entry geoIndexOutboxEntry, lastError string, next time.Time) error {
+	store := outbox.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current, ok := store.outbox[entry.FarmerID]
+	if !ok || current.Version != entry.Version {
+		return nil
+	}
+	current.Attempts++
+	current.LastError = lastError
+	current.NextAttemptAt = next
+	store.outbox[entry.FarmerID] = current
+	return nil
+}
+
+func (outbox memoryGeoIndexOutbox) FarmerIDs() (map[string]bool, error) {
+	store := outbox.store
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	pending := make(map[string]bool, len(store.outbox))
+	for id := range store.outbox {
+		pending[id.Hex()] = true
+	}
+	return pending, nil
+}
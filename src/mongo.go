@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"golang.org/x/exp/slices"
+)
+
+// The MongoDB client is shared by all requests of a process. It is connected
+// lazily on first use and then kept, so that warm AWS Lambda invocations and
+// requests in -port mode reuse its connection pool instead of paying for a
+// new connection and TLS handshake every time.
+var (
+	mongoClientMutex  sync.Mutex
+	sharedMongoClient *mongo.Client
+)
+
+// mongoClient returns the shared MongoDB client, connecting it if necessary.
+// A failed connection attempt is not remembered, the next call tries again.
+func mongoClient(ctx context.Context) (*mongo.Client, error) {
+	mongoClientMutex.Lock()
+	defer mongoClientMutex.Unlock()
+
+	if sharedMongoClient != nil {
+		return sharedMongoClient, nil
+	}
+	opts := options.Client().
+		ApplyURI(os.Getenv("MONGODB_CONNECTION_STRING")).
+		SetMaxConnIdleTime(5 * time.Minute)
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	sharedMongoClient = client
+	return client, nil
+}
+
+// pingMongo checks that the primary of the MongoDB deployment is reachable.
+func pingMongo(ctx context.Context) error {
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Ping(ctx, readpref.Primary())
+}
+
+// disconnectMongo closes the shared client, if it was ever connected.
+func disconnectMongo(ctx context.Context) error {
+	mongoClientMutex.Lock()
+	defer mongoClientMutex.Unlock()
+
+	if sharedMongoClient == nil {
+		return nil
+	}
+	err := sharedMongoClient.Disconnect(ctx)
+	sharedMongoClient = nil
+	return err
+}
+
+// toMongoPatch converts the non-empty fields of value into a $set document.
+// Fields listed in subdocuments are set using dotted paths, so that a patch
+// only touches the fields of a subdocument it actually contains.
+func toMongoPatch(value interface{}, subdocuments []string) (bson.D, error) {
+	b, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var document bson.D
+	if err := bson.Unmarshal(b, &document); err != nil {
+		return nil, err
+	}
+	patch := bson.D{}
+	for _, element := range document {
+		if sub, ok := element.Value.(bson.D); ok && slices.Contains(subdocuments, element.Key) {
+			for _, subElement := range sub {
+				patch = append(patch, bson.E{Key: element.Key + "." + subElement.Key, Value: subElement.Value})
+			}
+			continue
+		}
+		patch = append(patch, element)
+	}
+	return patch, nil
+}
+
+// withMongoTransaction runs fn in a transaction on a new session of client.
+// fn may be called more than once if the transaction has to be retried.
+func withMongoTransaction(ctx context.Context, client *mongo.Client, fn func(ctx mongo.SessionContext) error) error {
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessionCtx)
+	})
+	return err
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// geoJsonPoint is a GeoJSON point as understood by MongoDB's 2dsphere indexes.
+type geoJsonPoint struct {
+	Type        string    `bson:"type"`
+	Coordinates []float64 `bson:"coordinates"`
+}
+
+func toGeoJsonPoint(location geoLocation) geoJsonPoint {
+	return geoJsonPoint{Type: "Point", Coordinates: []float64{location.Longitude, location.Latitude}}
+}
+
+// farmerGeoSearcher is implemented by geo indexes that live next to the farmer
+// documents and can therefore apply the farmer filters in the same query,
+// saving the second round trip of getFarmersNearBy.
+type farmerGeoSearcher interface {
+	findFarmersNearBy(point geoLocation, maxDistance_km float64, tags farmerFilter) ([]farmer, error)
+}
+
+// mongoGeoIndex stores GeoJSON points in the `geo` field of the farmer
+// documents and answers radius queries with $geoNear on a 2dsphere index.
+type mongoGeoIndex struct {
+	ensureIndexMutex sync.Mutex
+	// hasIndex is only set once the index was created, so that a failure is
+	// retried by the next call
+	hasIndex bool
+}
+
+// ensureIndex creates the 2dsphere index and backfills the geo points once
+// per process. A failed backfill is only logged, so that searches keep
+// working, and is retried by the next process.
+func (index *mongoGeoIndex) ensureIndex(ctx context.Context, coll *mongo.Collection) error {
+	index.ensureIndexMutex.Lock()
+	defer index.ensureIndexMutex.Unlock()
+	if index.hasIndex {
+		return nil
+	}
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"geo", "2dsphere"}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := backfillGeoJsonPoints(ctx, coll); err != nil {
+		log.Print(err)
+	}
+	index.hasIndex = true
+	return nil
+}
+
+// backfillGeoJsonPoints sets the geo point of the verified farmers that have
+// a location but no geo point, such as those stored before GEO_INDEX was
+// switched to mongo, which $geoNear would skip otherwise. Farmers written
+// since get their point through the outbox. `-reconcile` reports any farmer
+// still missing.
+func backfillGeoJsonPoints(ctx context.Context, coll *mongo.Collection) error {
+	filter := bson.D{{"$and", bson.A{
+		bson.D{{"geo", bson.D{{"$exists", false}}}},
+		bson.D{{"location", bson.D{{"$exists", true}}}},
+		verifiedFarmerFilter,
+	}}}
+	// a zero coordinate is omitted from the location, like on the farmer
+	update := mongo.Pipeline{{{"$set", bson.D{{"geo", bson.D{
+		{"type", "Point"},
+		{"coordinates", bson.A{
+			bson.D{{"$ifNull", bson.A{"$location.longitude", 0}}},
+			bson.D{{"$ifNull", bson.A{"$location.latitude", 0}}},
+		}},
+	}}}}}}
+	result, err := coll.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("Could not backfill the geo points: %w", err)
+	}
+	if result.ModifiedCount > 0 {
+		log.Printf("Backfilled the geo points of %d farmers", result.ModifiedCount)
+	}
+	return nil
+}
+
+func (index *mongoGeoIndex) Insert(id string, location geoLocation) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("farmers")
+	if err := index.ensureIndex(ctx, coll); err != nil {
+		return err
+	}
+	filter := bson.D{{"_id", bson.D{{"$eq", objectId}}}}
+	update := bson.D{{"$set", bson.D{{"geo", toGeoJsonPoint(location)}}}}
+	_, err = coll.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (index *mongoGeoIndex) Delete(id string) error {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("farmers")
+	filter := bson.D{{"_id", bson.D{{"$eq", objectId}}}}
+	update := bson.D{{"$unset", bson.D{{"geo", ""}}}}
+	_, err = coll.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (index *mongoGeoIndex) QueryRadius(point geoLocation, maxDistance_km float64) (map[string]float64, error) {
+	results, err := index.geoNear(point, maxDistance_km, bson.D{}, bson.D{{"_id", 1}, {"distance_m", 1}})
+	if err != nil {
+		return nil, err
+	}
+	idsAndDistances := make(map[string]float64)
+	for _, result := range results {
+		idsAndDistances[result.farmer.MongoDbID.Hex()] = result.Distance_m
+	}
+	return idsAndDistances, nil
+}
+
+func (index *mongoGeoIndex) All() (map[string]geoLocation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("farmers")
+	filter := bson.D{{"geo", bson.D{{"$exists", true}}}}
+	opts := options.Find().SetProjection(bson.D{{"_id", 1}, {"geo", 1}})
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var farmers []farmer
+	if err = cursor.All(ctx, &farmers); err != nil {
+		return nil, err
+	}
+
+	locations := make(map[string]geoLocation, len(farmers))
+	for _, farmer := range farmers {
+		if farmer.Geo == nil || len(farmer.Geo.Coordinates) != 2 {
+			continue
+		}
+		locations[farmer.MongoDbID.Hex()] = geoLocation{
+			Longitude: farmer.Geo.Coordinates[0],
+			Latitude:  farmer.Geo.Coordinates[1],
+		}
+	}
+	return locations, nil
+}
+
+func (index *mongoGeoIndex) findFarmersNearBy(point geoLocation, maxDistance_km float64, tags farmerFilter) ([]farmer, error) {
+	// the geo points of farmers that are not verified are removed through the
+	// outbox, which may lag behind
+	query := bson.D{{"$and", bson.A{tags.mongoQuery(), verifiedFarmerFilter}}}
+	results, err := index.geoNear(point, maxDistance_km, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	farmers := make([]farmer, 0, len(results))
+	for _, result := range results {
+		result.farmer.Distance_km = result.Distance_m / 1000
+		farmers = append(farmers, result.farmer)
+	}
+	return farmers, nil
+}
+
+type farmerWithDistance struct {
+	farmer     farmer
+	Distance_m float64
+}
+
+// geoNear runs $geoNear on the farmers collection, restricted by query and
+// optionally projected. Results are ordered by increasing distance and capped
+// at maxRadiusResults.
+func (index *mongoGeoIndex) geoNear(point geoLocation, maxDistance_km float64, query bson.D, projection bson.D) ([]farmerWithDistance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("farmers")
+	if err := index.ensureIndex(ctx, coll); err != nil {
+		return nil, err
+	}
+	pipeline := mongo.Pipeline{
+		{{"$geoNear", bson.D{
+			{"near", toGeoJsonPoint(point)},
+			{"key", "geo"},
+			{"distanceField", "distance_m"},
+			{"maxDistance", maxDistance_km * 1000},
+			{"spherical", true},
+			{"query", query},
+		}}},
+		{{"$limit", maxRadiusResults}},
+	}
+	if projection != nil {
+		pipeline = append(pipeline, bson.D{{"$project", projection}})
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var documents []bson.Raw = make([]bson.Raw, 0)
+	if err = cursor.All(ctx, &documents); err != nil {
+		return nil, err
+	}
+	// the distance is not part of the farmer document, so decode it separately
+	results := make([]farmerWithDistance, 0, len(documents))
+	for _, document := range documents {
+		var result farmerWithDistance
+		if err := bson.Unmarshal(document, &result.farmer); err != nil {
+			return nil, err
+		}
+		distance, err := document.LookupErr("distance_m")
+		if err != nil {
+			return nil, err
+		}
+		distance_m, ok := distance.DoubleOK()
+		if !ok {
+			return nil, fmt.Errorf("Expected distance_m to be a double, got %s", distance.Type)
+		}
+		result.Distance_m = distance_m
+		results = append(results, result)
+	}
+	return results, nil
+}
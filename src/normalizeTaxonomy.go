@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// taxonomyRename is a stored grocery type or feature and the taxonomy id it
+// is normalized to, which is empty if it cannot be mapped.
+type taxonomyRename struct {
+	// Kind is "groceryType" or "feature"
+	Kind  string
+	Value string
+	ID    string
+	// Count is the number of products or farmers storing the value
+	Count int64
+}
+
+func (r taxonomyRename) String() string {
+	noun := "products"
+	if r.Kind == "feature" {
+		noun = "farmers"
+	}
+	if len(r.ID) <= 0 {
+		return fmt.Sprintf("unknown %s '%s' of %d %s", r.Kind, r.Value, r.Count, noun)
+	}
+	return fmt.Sprintf("rename  %s '%s' to '%s' on %d %s", r.Kind, r.Value, r.ID, r.Count, noun)
+}
+
+// findTaxonomyRenames lists the stored grocery types of products and
+// features of farmers that are not taxonomy ids, together with the id they
+// are a name of, if any.
+func (app *app) findTaxonomyRenames() ([]taxonomyRename, error) {
+	renames := make([]taxonomyRename, 0)
+	groceryTypes, err := app.products.GroceryTypes()
+	if err != nil {
+		return nil, err
+	}
+	for value, count := range groceryTypes {
+		if app.taxonomy.isGroceryType(value) {
+			continue
+		}
+		id, _ := app.taxonomy.groceryTypeId(value)
+		renames = append(renames, taxonomyRename{Kind: "groceryType", Value: value, ID: id, Count: count})
+	}
+
+	features, err := app.farmers.Features()
+	if err != nil {
+		return nil, err
+	}
+	featureCounts := make(map[string]int64)
+	for _, values := range features {
+		for _, value := range values {
+			featureCounts[value]++
+		}
+	}
+	for value, count := range featureCounts {
+		if app.taxonomy.isFeature(value) {
+			continue
+		}
+		id, _ := app.taxonomy.featureId(value)
+		renames = append(renames, taxonomyRename{Kind: "feature", Value: value, ID: id, Count: count})
+	}
+
+	sort.Slice(renames, func(i, j int) bool {
+		if renames[i].Kind != renames[j].Kind {
+			return renames[i].Kind > renames[j].Kind
+		}
+		return renames[i].Value < renames[j].Value
+	})
+	return renames, nil
+}
+
+// normalizeTaxonomy rewrites the grocery types of products and the features
+// of farmers stored before the taxonomy to taxonomy ids, reporting every
+// rename and every value that cannot be mapped to out. With dryRun set it
+// only reports. It returns the number of values that cannot be mapped, which
+// have to be fixed by hand.
+func (app *app) normalizeTaxonomy(dryRun bool, out io.Writer) (int, error) {
+	renames, err := app.findTaxonomyRenames()
+	if err != nil {
+		return 0, err
+	}
+
+	unknown := 0
+	for _, r := range renames {
+		if len(r.ID) <= 0 {
+			unknown++
+		}
+		fmt.Fprintln(out, r)
+	}
+	if dryRun {
+		fmt.Fprintf(out, "%d values to rename, %d unknown (dry run, nothing changed)\n", len(renames)-unknown, unknown)
+		return unknown, nil
+	}
+
+	var productsUpdated int64
+	for _, r := range renames {
+		if r.Kind != "groceryType" || len(r.ID) <= 0 {
+			continue
+		}
+		updated, err := app.products.RenameGroceryType(r.Value, r.ID)
+		if err != nil {
+			return unknown, err
+		}
+		productsUpdated += updated
+	}
+	// the grocery types of the farmers are derived from their products
+	if _, err := app.products.RebuildGroceryTypes(); err != nil {
+		return unknown, err
+	}
+
+	features, err := app.farmers.Features()
+	if err != nil {
+		return unknown, err
+	}
+	ids := maps.Keys(features)
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Hex() < ids[j].Hex() })
+	farmersUpdated := 0
+	for _, id := range ids {
+		normalized := app.taxonomy.normalizeFeatures(features[id])
+		if slices.Equal(normalized, features[id]) {
+			continue
+		}
+		if _, err := app.farmers.Update(id, farmer{Features: normalized}); err != nil {
+			return unknown, err
+		}
+		farmersUpdated++
+	}
+	fmt.Fprintf(out, "%d products and %d farmers updated, %d unknown values left\n", productsUpdated, farmersUpdated, unknown)
+	return unknown, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestNormalizeTaxonomy(t *testing.T) {
+	app, _ := newTestServer(t)
+	// stored before the taxonomy, so not normalized on write
+	legacy, err := app.farmers.Insert(farmer{Name: "Hof Müller", Features: []string{"Hofladen", "farm-shop", "Streichelzoo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.products.Insert(legacy.MongoDbID, []product{
+		{Name: "Ziegenkäse", GroceryType: "chevre"},
+		{Name: "Honig", GroceryType: "honey"},
+		{Name: "Zauberbohnen", GroceryType: "magic beans"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	unknown, err := app.normalizeTaxonomy(true, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unknown != 2 {
+		t.Errorf("Expected 2 unknown values, got %d:\n%s", unknown, out.String())
+	}
+	for _, line := range []string{
+		"rename  groceryType 'chevre' to 'goat-cheese' on 1 products",
+		"unknown groceryType 'magic beans' of 1 products",
+		"rename  feature 'Hofladen' to 'farm-shop' on 1 farmers",
+		"unknown feature 'Streichelzoo' of 1 farmers",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected the report to contain %q, got:\n%s", line, out.String())
+		}
+	}
+	if stored, _ := app.farmers.Get(legacy.MongoDbID); !slices.Equal(stored.Features, legacy.Features) {
+		t.Errorf("Expected a dry run to change nothing, got %v", stored.Features)
+	}
+
+	if _, err := app.normalizeTaxonomy(false, &out); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := app.farmers.Get(legacy.MongoDbID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(stored.Features, []string{"farm-shop", "Streichelzoo"}) {
+		t.Errorf("Expected the features to be normalized, got %v", stored.Features)
+	}
+	if !slices.Equal(stored.GroceryTypes, []string{"goat-cheese", "honey", "magic beans"}) {
+		t.Errorf("Expected the grocery types to be rebuilt, got %v", stored.GroceryTypes)
+	}
+
+	out.Reset()
+	if unknown, err := app.normalizeTaxonomy(true, &out); err != nil || unknown != 2 || strings.Contains(out.String(), "rename  ") {
+		t.Errorf("Expected only the unknown values to be left, got %d, %v:\n%s", unknown, err, out.String())
+	}
+}
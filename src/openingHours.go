@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const secondsPerDay = 24 * 60 * 60
+
+// timeInterval is a half-open interval [Start, End). An interval with
+// Start == End denotes a single instant.
+type timeInterval struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (i timeInterval) isInstant() bool {
+	return i.Start.Equal(i.End)
+}
+
+// overlaps reports whether i and other share at least one instant.
+func (i timeInterval) overlaps(other timeInterval) bool {
+	if other.isInstant() {
+		return !other.Start.Before(i.Start) && other.Start.Before(i.End)
+	}
+	return i.Start.Before(other.End) && other.Start.Before(i.End)
+}
+
+// openingHoursDayKey returns the key used in
+// OpeningHoursByDayOfWeekSecondsFromStartOfDay for the given day, e.g. "monday".
+func openingHoursDayKey(day time.Weekday) string {
+	return strings.ToLower(day.String())
+}
+
+// openingHoursForDay returns the ranges stored for the given day. Keys are
+// matched case-insensitively so "Monday" and "monday" are treated alike.
+func openingHoursForDay(openingHours map[string][][]int32, day time.Weekday) [][]int32 {
+	key := openingHoursDayKey(day)
+	if ranges, ok := openingHours[key]; ok {
+		return ranges
+	}
+	for k, ranges := range openingHours {
+		if strings.ToLower(k) == key {
+			return ranges
+		}
+	}
+	return nil
+}
+
+// timeZone returns the location the farmer's opening hours are expressed in.
+// Farmers without a (valid) time zone are evaluated in UTC.
+func (f farmer) timeZone() *time.Location {
+	if len(f.TimeZone) <= 0 {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(f.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// openingIntervals expands the farmer's weekly opening hours into absolute,
+// merged intervals covering at least [from, to]. Ranges whose end lies before
+// their start cross midnight and continue on the following day.
+func openingIntervals(f farmer, from time.Time, to time.Time) []timeInterval {
+	loc := f.timeZone()
+	from = from.In(loc)
+	to = to.In(loc)
+
+	// start one day early so that ranges crossing midnight into `from` are included
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, -1)
+	intervals := make([]timeInterval, 0)
+	for !day.After(to) {
+		for _, r := range openingHoursForDay(f.OpeningHoursByDayOfWeekSecondsFromStartOfDay, day.Weekday()) {
+			if len(r) != 2 {
+				continue
+			}
+			startSeconds, endSeconds := int(r[0]), int(r[1])
+			if endSeconds <= startSeconds {
+				endSeconds += secondsPerDay
+			}
+			// time.Date normalises overflowing seconds, which keeps wall clock
+			// times correct across daylight saving transitions
+			intervals = append(intervals, timeInterval{
+				Start: time.Date(day.Year(), day.Month(), day.Day(), 0, 0, startSeconds, 0, loc),
+				End:   time.Date(day.Year(), day.Month(), day.Day(), 0, 0, endSeconds, 0, loc),
+			})
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return mergeIntervals(intervals)
+}
+
+// mergeIntervals sorts the intervals and joins those that overlap or touch.
+func mergeIntervals(intervals []timeInterval) []timeInterval {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].Start.Before(intervals[j].Start)
+	})
+	merged := make([]timeInterval, 0, len(intervals))
+	for _, interval := range intervals {
+		last := len(merged) - 1
+		if last >= 0 && !interval.Start.After(merged[last].End) {
+			if interval.End.After(merged[last].End) {
+				merged[last].End = interval.End
+			}
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
+
+// isOpenDuring reports whether the farmer is open at some point during the
+// interval, or at the instant if the interval is one.
+func isOpenDuring(f farmer, interval timeInterval) bool {
+	// opening hours repeat weekly, so looking beyond a week plus a day for
+	// ranges crossing midnight cannot change the outcome
+	if interval.End.Sub(interval.Start) > 8*secondsPerDay*time.Second {
+		interval.End = interval.Start.Add(8 * secondsPerDay * time.Second)
+	}
+	for _, opening := range openingIntervals(f, interval.Start, interval.End) {
+		if opening.overlaps(interval) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterFarmersByOpeningHours(farmers []farmer, interval timeInterval) []farmer {
+	results := make([]farmer, 0, len(farmers))
+	for _, f := range farmers {
+		if isOpenDuring(f, interval) {
+			results = append(results, f)
+		}
+	}
+	return results
+}
+
+// setOpeningStatus fills IsOpenNow, NextOpensAt and NextClosesAt as seen at
+// now. The times are expressed in the farmer's time zone. A farmer open around
+// the clock has no NextClosesAt, one without opening hours no NextOpensAt.
+func setOpeningStatus(f *farmer, now time.Time) {
+	f.IsOpenNow = false
+	f.NextOpensAt = nil
+	f.NextClosesAt = nil
+
+	horizon := now.Add(8 * secondsPerDay * time.Second)
+	for _, opening := range openingIntervals(*f, now, horizon) {
+		if !opening.End.After(now) {
+			continue
+		}
+		if !opening.Start.After(now) {
+			f.IsOpenNow = true
+			if opening.End.Before(horizon) {
+				closesAt := opening.End
+				f.NextClosesAt = &closesAt
+			}
+			continue
+		}
+		opensAt := opening.Start
+		f.NextOpensAt = &opensAt
+		if f.NextClosesAt == nil && opening.End.Before(horizon) {
+			closesAt := opening.End
+			f.NextClosesAt = &closesAt
+		}
+		return
+	}
+}
+
+// parseISO8601Interval parses an ISO 8601 instant ("2023-06-01T10:00:00+02:00")
+// or time interval in one of the forms "<start>/<end>", "<start>/<duration>"
+// and "<duration>/<end>". Instants must carry a UTC offset.
+func parseISO8601Interval(s string) (timeInterval, error) {
+	parts := strings.Split(s, "/")
+	switch len(parts) {
+	case 1:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return timeInterval{}, fmt.Errorf("Invalid ISO 8601 instant: %s", s)
+		}
+		return timeInterval{Start: t, End: t}, nil
+	case 2:
+		var interval timeInterval
+		if strings.HasPrefix(parts[0], "P") {
+			end, err := time.Parse(time.RFC3339, parts[1])
+			if err != nil {
+				return timeInterval{}, fmt.Errorf("Invalid ISO 8601 interval end: %s", parts[1])
+			}
+			d, err := parseISO8601Duration(parts[0])
+			if err != nil {
+				return timeInterval{}, err
+			}
+			interval = timeInterval{Start: d.subtractFrom(end), End: end}
+		} else {
+			start, err := time.Parse(time.RFC3339, parts[0])
+			if err != nil {
+				return timeInterval{}, fmt.Errorf("Invalid ISO 8601 interval start: %s", parts[0])
+			}
+			if strings.HasPrefix(parts[1], "P") {
+				d, err := parseISO8601Duration(parts[1])
+				if err != nil {
+					return timeInterval{}, err
+				}
+				interval = timeInterval{Start: start, End: d.addTo(start)}
+			} else {
+				end, err := time.Parse(time.RFC3339, parts[1])
+				if err != nil {
+					return timeInterval{}, fmt.Errorf("Invalid ISO 8601 interval end: %s", parts[1])
+				}
+				interval = timeInterval{Start: start, End: end}
+			}
+		}
+		if interval.End.Before(interval.Start) {
+			return timeInterval{}, fmt.Errorf("Invalid ISO 8601 interval, end is before start: %s", s)
+		}
+		return interval, nil
+	default:
+		return timeInterval{}, fmt.Errorf("Invalid ISO 8601 instant or interval: %s", s)
+	}
+}
+
+// isoDuration is an ISO 8601 duration. Calendar components are kept apart
+// from the clock components so that "P1D" means the same wall clock time on
+// the next day even across daylight saving transitions.
+type isoDuration struct {
+	Years, Months, Weeks, Days int
+	Clock                      time.Duration
+}
+
+func (d isoDuration) addTo(t time.Time) time.Time {
+	return t.AddDate(d.Years, d.Months, d.Weeks*7+d.Days).Add(d.Clock)
+}
+
+func (d isoDuration) subtractFrom(t time.Time) time.Time {
+	return t.Add(-d.Clock).AddDate(-d.Years, -d.Months, -(d.Weeks*7 + d.Days))
+}
+
+var iso8601DurationRegexp = regexp.MustCompile(`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:[.,]\d+)?)S)?)?$`)
+
+// parseISO8601Duration parses durations such as "PT2H", "P1DT30M" or "P1W".
+func parseISO8601Duration(s string) (isoDuration, error) {
+	m := iso8601DurationRegexp.FindStringSubmatch(s)
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return isoDuration{}, fmt.Errorf("Invalid ISO 8601 duration: %s", s)
+	}
+	atoi := func(s string) int {
+		if len(s) <= 0 {
+			return 0
+		}
+		i, _ := strconv.Atoi(s)
+		return i
+	}
+	var d isoDuration
+	d.Years = atoi(m[1])
+	d.Months = atoi(m[2])
+	d.Weeks = atoi(m[3])
+	d.Days = atoi(m[4])
+	d.Clock = time.Duration(atoi(m[5]))*time.Hour + time.Duration(atoi(m[6]))*time.Minute
+	if len(m[7]) > 0 {
+		seconds, err := strconv.ParseFloat(strings.Replace(m[7], ",", ".", 1), 64)
+		if err != nil {
+			return isoDuration{}, fmt.Errorf("Invalid ISO 8601 duration: %s", s)
+		}
+		d.Clock += time.Duration(seconds * float64(time.Second))
+	}
+	return d, nil
+}
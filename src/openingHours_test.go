@@ -0,0 +1,244 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustParseTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestOpeningIntervalsAcrossMidnight(t *testing.T) {
+	// Friday 22:00 until Saturday 02:00
+	f := farmer{
+		TimeZone: "UTC",
+		OpeningHoursByDayOfWeekSecondsFromStartOfDay: map[string][][]int32{
+			"friday": {{22 * 3600, 2 * 3600}},
+		},
+	}
+	// 2023-06-03 is a Saturday
+	from := mustParseTime(t, "2023-06-03T01:00:00Z")
+	intervals := openingIntervals(f, from, from)
+	if len(intervals) != 1 {
+		t.Fatalf("Expected 1 interval, got %v", intervals)
+	}
+	wantStart := mustParseTime(t, "2023-06-02T22:00:00Z")
+	wantEnd := mustParseTime(t, "2023-06-03T02:00:00Z")
+	if !intervals[0].Start.Equal(wantStart) || !intervals[0].End.Equal(wantEnd) {
+		t.Errorf("Expected %s to %s, got %s to %s", wantStart, wantEnd, intervals[0].Start, intervals[0].End)
+	}
+}
+
+func TestOpeningIntervalsMergesAdjacentRanges(t *testing.T) {
+	f := farmer{
+		OpeningHoursByDayOfWeekSecondsFromStartOfDay: map[string][][]int32{
+			"Monday": {{8 * 3600, 12 * 3600}, {12 * 3600, 18 * 3600}},
+		},
+	}
+	// 2023-06-05 is a Monday
+	from := mustParseTime(t, "2023-06-05T00:00:00Z")
+	intervals := openingIntervals(f, from, from.Add(12*time.Hour))
+	if len(intervals) != 1 {
+		t.Fatalf("Expected the ranges to merge into 1 interval, got %v", intervals)
+	}
+	if got := intervals[0].End.Sub(intervals[0].Start); got != 10*time.Hour {
+		t.Errorf("Expected 10 hours, got %s", got)
+	}
+}
+
+func TestOpeningIntervalsAcrossDaylightSavingTime(t *testing.T) {
+	// clocks in Berlin go from 02:00 to 03:00 on Sunday, 2023-03-26
+	f := farmer{
+		TimeZone: "Europe/Berlin",
+		OpeningHoursByDayOfWeekSecondsFromStartOfDay: map[string][][]int32{
+			"saturday": {{22 * 3600, 6 * 3600}},
+			"sunday":   {{8 * 3600, 18 * 3600}},
+		},
+	}
+	from := mustParseTime(t, "2023-03-25T12:00:00Z")
+	intervals := openingIntervals(f, from, from.Add(36*time.Hour))
+	tests := []struct {
+		start string
+		end   string
+	}{
+		// the night is an hour shorter
+		{"2023-03-25T22:00:00+01:00", "2023-03-26T06:00:00+02:00"},
+		// and the day keeps its wall clock times
+		{"2023-03-26T08:00:00+02:00", "2023-03-26T18:00:00+02:00"},
+	}
+	if len(intervals) != len(tests) {
+		t.Fatalf("Expected %d intervals, got %v", len(tests), intervals)
+	}
+	for i, test := range tests {
+		start, end := mustParseTime(t, test.start), mustParseTime(t, test.end)
+		if !intervals[i].Start.Equal(start) || !intervals[i].End.Equal(end) {
+			t.Errorf("Expected %s to %s, got %s to %s", start, end, intervals[i].Start, intervals[i].End)
+		}
+	}
+	if got := intervals[0].End.Sub(intervals[0].Start); got != 7*time.Hour {
+		t.Errorf("Expected the night to last 7 hours, got %s", got)
+	}
+}
+
+func TestIsOpenDuring(t *testing.T) {
+	f := farmer{
+		TimeZone: "Europe/Berlin",
+		OpeningHoursByDayOfWeekSecondsFromStartOfDay: map[string][][]int32{
+			"monday": {{9 * 3600, 17 * 3600}},
+		},
+	}
+	tests := []struct {
+		interval string
+		want     bool
+	}{
+		{"2023-06-05T10:00:00+02:00", true},
+		{"2023-06-05T09:00:00+02:00", true},
+		// intervals are half open
+		{"2023-06-05T17:00:00+02:00", false},
+		{"2023-06-05T18:00:00+02:00/PT1H", false},
+		{"2023-06-05T16:30:00+02:00/PT1H", true},
+		{"PT2H/2023-06-05T10:00:00+02:00", true},
+		{"2023-06-06T00:00:00+02:00/P1W", true},
+		{"2023-06-06T00:00:00+02:00/P5D", false},
+	}
+	for _, test := range tests {
+		interval, err := parseISO8601Interval(test.interval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isOpenDuring(f, interval); got != test.want {
+			t.Errorf("isOpenDuring(%s) = %v, expected %v", test.interval, got, test.want)
+		}
+	}
+}
+
+func TestParseISO8601Interval(t *testing.T) {
+	tests := []struct {
+		s     string
+		start string
+		end   string
+	}{
+		{"2023-06-01T10:00:00+02:00", "2023-06-01T10:00:00+02:00", "2023-06-01T10:00:00+02:00"},
+		{"2023-06-01T10:00:00Z/2023-06-01T12:00:00Z", "2023-06-01T10:00:00Z", "2023-06-01T12:00:00Z"},
+		{"2023-06-01T10:00:00Z/PT1H30M", "2023-06-01T10:00:00Z", "2023-06-01T11:30:00Z"},
+		{"P1D/2023-06-02T10:00:00Z", "2023-06-01T10:00:00Z", "2023-06-02T10:00:00Z"},
+		{"2023-01-31T00:00:00Z/P1M", "2023-01-31T00:00:00Z", "2023-03-03T00:00:00Z"},
+	}
+	for _, test := range tests {
+		interval, err := parseISO8601Interval(test.s)
+		if err != nil {
+			t.Errorf("parseISO8601Interval(%s) failed: %s", test.s, err)
+			continue
+		}
+		start, end := mustParseTime(t, test.start), mustParseTime(t, test.end)
+		if !interval.Start.Equal(start) || !interval.End.Equal(end) {
+			t.Errorf("parseISO8601Interval(%s) = %s to %s, expected %s to %s", test.s, interval.Start, interval.End, start, end)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"2023-06-01T10:00:00",
+		"2023-06-01",
+		"2023-06-01T12:00:00Z/2023-06-01T10:00:00Z",
+		"PT1H/PT2H",
+		"2023-06-01T10:00:00Z/2023-06-01T12:00:00Z/PT1H",
+	} {
+		if _, err := parseISO8601Interval(s); err == nil {
+			t.Errorf("parseISO8601Interval(%q) succeeded, expected an error", s)
+		}
+	}
+}
+
+func TestParseISO8601Duration(t *testing.T) {
+	tests := []struct {
+		s    string
+		want isoDuration
+	}{
+		{"PT2H", isoDuration{Clock: 2 * time.Hour}},
+		{"P1DT30M", isoDuration{Days: 1, Clock: 30 * time.Minute}},
+		{"P1W", isoDuration{Weeks: 1}},
+		{"P1Y2M3D", isoDuration{Years: 1, Months: 2, Days: 3}},
+		{"PT1.5S", isoDuration{Clock: 1500 * time.Millisecond}},
+		{"PT0,25S", isoDuration{Clock: 250 * time.Millisecond}},
+	}
+	for _, test := range tests {
+		d, err := parseISO8601Duration(test.s)
+		if err != nil {
+			t.Errorf("parseISO8601Duration(%s) failed: %s", test.s, err)
+			continue
+		}
+		if d != test.want {
+			t.Errorf("parseISO8601Duration(%s) = %+v, expected %+v", test.s, d, test.want)
+		}
+	}
+
+	for _, s := range []string{"", "P", "PT", "P1H", "PT1D", "1D", "P-1D", "P1DT"} {
+		if _, err := parseISO8601Duration(s); err == nil {
+			t.Errorf("parseISO8601Duration(%q) succeeded, expected an error", s)
+		}
+	}
+}
+
+func TestSetOpeningStatus(t *testing.T) {
+	weekdays := map[string][][]int32{
+		"monday":  {{9 * 3600, 17 * 3600}},
+		"tuesday": {{9 * 3600, 17 * 3600}},
+	}
+	tests := []struct {
+		name         string
+		openingHours map[string][][]int32
+		now          string
+		wantOpen     bool
+		wantOpensAt  string
+		wantClosesAt string
+	}{
+		{"open", weekdays, "2023-06-05T10:00:00Z", true, "2023-06-06T09:00:00Z", "2023-06-05T17:00:00Z"},
+		{"closed in between", weekdays, "2023-06-05T20:00:00Z", false, "2023-06-06T09:00:00Z", "2023-06-06T17:00:00Z"},
+		{"closed until next week", weekdays, "2023-06-07T10:00:00Z", false, "2023-06-12T09:00:00Z", "2023-06-12T17:00:00Z"},
+		{"closing now", weekdays, "2023-06-05T17:00:00Z", false, "2023-06-06T09:00:00Z", "2023-06-06T17:00:00Z"},
+		{"no opening hours", nil, "2023-06-05T10:00:00Z", false, "", ""},
+	}
+	for _, test := range tests {
+		f := farmer{OpeningHoursByDayOfWeekSecondsFromStartOfDay: test.openingHours}
+		setOpeningStatus(&f, mustParseTime(t, test.now))
+		if f.IsOpenNow != test.wantOpen {
+			t.Errorf("%s: IsOpenNow = %v, expected %v", test.name, f.IsOpenNow, test.wantOpen)
+		}
+		checkTime(t, test.name+": NextOpensAt", f.NextOpensAt, test.wantOpensAt)
+		checkTime(t, test.name+": NextClosesAt", f.NextClosesAt, test.wantClosesAt)
+	}
+}
+
+func TestSetOpeningStatusAroundTheClock(t *testing.T) {
+	openingHours := make(map[string][][]int32)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		openingHours[openingHoursDayKey(day)] = [][]int32{{0, 0}}
+	}
+	f := farmer{OpeningHoursByDayOfWeekSecondsFromStartOfDay: openingHours}
+	setOpeningStatus(&f, mustParseTime(t, "2023-06-05T10:00:00Z"))
+	if !f.IsOpenNow || f.NextOpensAt != nil || f.NextClosesAt != nil {
+		t.Errorf("Expected to be open without closing, got %v, %v, %v", f.IsOpenNow, f.NextOpensAt, f.NextClosesAt)
+	}
+}
+
+func checkTime(t *testing.T, name string, got *time.Time, want string) {
+	t.Helper()
+	if len(want) <= 0 {
+		if got != nil {
+			t.Errorf("%s = %s, expected none", name, got)
+		}
+		return
+	}
+	if got == nil {
+		t.Errorf("%s is missing, expected %s", name, want)
+	} else if !got.Equal(mustParseTime(t, want)) {
+		t.Errorf("%s = %s, expected %s", name, got, want)
+	}
+}
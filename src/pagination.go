@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// default and maximum number of results returned per page
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// pageToken is handed to clients as an opaque cursor pointing at the first
+// result of the next page. It remembers the sort order it was issued for so a
+// token cannot be replayed against a differently ordered result.
+//
+// The token is an offset into the result of the search, which is run again
+// for every page. Kinetica's paging table cannot serve as the cursor, as it
+// pages through the geo query only, whereas the filters, text matching and
+// sort order are applied afterwards. Instead, searches consider at most the
+// maxRadiusResults nearest farmers, so that a page never costs more than
+// that.
+type pageToken struct {
+	Offset int    `json:"o"`
+	Sort   string `json:"s"`
+}
+
+func encodePageToken(token pageToken) string {
+	b, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePageToken(s string) (pageToken, error) {
+	var token pageToken
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return token, fmt.Errorf("Invalid page token: %s", s)
+	}
+	if err := json.Unmarshal(b, &token); err != nil || token.Offset < 0 {
+		return token, fmt.Errorf("Invalid page token: %s", s)
+	}
+	return token, nil
+}
+
+// pageBounds returns the slice bounds of the page starting at offset within
+// total results, and whether further results follow it.
+func pageBounds(total int, offset int, limit int) (int, int, bool) {
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end, end < total
+}
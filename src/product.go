@@ -1,16 +1,11 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"os"
 	"strings"
-	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type price struct {
@@ -42,39 +37,19 @@ func fromJsonProductId(id string) (primitive.ObjectID, error) {
 	return primitive.ObjectIDFromHex(id[2:])
 }
 
-func getProductsByFarmer(farmerId string) ([]product, error) {
-	client, err := mongo.NewClient(options.Client().ApplyURI(os.Getenv("MONGODB_CONNECTION_STRING")))
-	if err != nil {
-		return nil, err
-	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	err = client.Connect(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer client.Disconnect(ctx)
-
-	coll := client.Database("shopGreenDB").Collection("products")
+var errProductNotFound = errors.New("Product not found")
 
+func (app *app) getProductsByFarmer(farmerId string) ([]product, error) {
 	// convert farmerId to bson object ids
 	farmerObjectId, err := fromJsonFarmerId(farmerId)
 	if err != nil {
 		return nil, err
 	}
-	filter := bson.D{{"farmerId", bson.D{{"$eq", farmerObjectId}}}}
-	// sort := bson.D{{"date_ordered", 1}}
-	opts := options.Find() //.SetSort(sort)
-
-	cursor, err := coll.Find(ctx, filter, opts)
+	results, err := app.products.ByFarmer(farmerObjectId)
 	if err != nil {
 		return nil, err
 	}
 
-	var results []product = make([]product, 0)
-	if err = cursor.All(ctx, &results); err != nil {
-		return nil, err
-	}
-
 	for i, result := range results {
 		results[i].ID = toJsonProductId(result.MongoDbID)
 	}
@@ -82,61 +57,76 @@ func getProductsByFarmer(farmerId string) ([]product, error) {
 	return results, nil
 }
 
-func addProducts(farmerId string, products []product) ([]product, error) {
+func (app *app) addProducts(farmerId string, products []product) ([]product, error) {
 	// convert farmerId to bson object ids
 	farmerObjectId, err := fromJsonFarmerId(farmerId)
 	if err != nil {
 		return nil, err
 	}
-
 	for i := range products {
-		products[i].MongoDbID = primitive.ObjectID{}
-		products[i].MongoDbFarmerID = farmerObjectId
+		products[i].GroceryType = app.taxonomy.normalizeGroceryType(products[i].GroceryType)
+	}
+	if err := validateProducts(app.taxonomy, products); err != nil {
+		return nil, err
 	}
 
-	// Connect to MongoDB
-	client, err := mongo.NewClient(options.Client().ApplyURI(os.Getenv("MONGODB_CONNECTION_STRING")))
+	products, err = app.products.Insert(farmerObjectId, products)
 	if err != nil {
 		return products, err
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	err = client.Connect(ctx)
-	if err != nil {
-		return products, err
+	for i := range products {
+		products[i].ID = toJsonProductId(products[i].MongoDbID)
+		products[i].FarmerID = toJsonFarmerId(products[i].MongoDbFarmerID)
 	}
-	defer client.Disconnect(ctx)
 
-	// Insert products
-	coll := client.Database("shopGreenDB").Collection("products")
-	documents := make([]interface{}, 0)
-	for _, product := range products {
-		documents = append(documents, product)
+	return products, nil
+}
+
+func (app *app) getProduct(productId string) (product, error) {
+	productObjectId, err := fromJsonProductId(productId)
+	if err != nil {
+		return product{}, err
 	}
-	result, err := coll.InsertMany(ctx, documents)
+	result, err := app.products.Get(productObjectId)
 	if err != nil {
-		return products, err
+		return product{}, err
 	}
-	if len(result.InsertedIDs) != len(products) {
-		return products, fmt.Errorf("Expected %d inserted ids, got %d", len(products), len(result.InsertedIDs))
+	result.ID = toJsonProductId(result.MongoDbID)
+	result.FarmerID = toJsonFarmerId(result.MongoDbFarmerID)
+	return result, nil
+}
+
+// updateProduct applies the non-empty fields of changes to the product and
+// recomputes the farmer's grocery types if the grocery type changed.
+func (app *app) updateProduct(productId string, changes product) (product, error) {
+	productObjectId, err := fromJsonProductId(productId)
+	if err != nil {
+		return product{}, err
 	}
-	for i := range products {
-		products[i].MongoDbID = result.InsertedIDs[i].(primitive.ObjectID)
-		products[i].ID = toJsonProductId(products[i].MongoDbID)
-		products[i].FarmerID = toJsonFarmerId(products[i].MongoDbFarmerID)
+	if len(changes.GroceryType) > 0 {
+		changes.GroceryType = app.taxonomy.normalizeGroceryType(changes.GroceryType)
 	}
-
-	// mongo db update farmer's grocery types to include the new product's grocery types
-	groceryTypes := make([]string, 0)
-	for _, product := range products {
-		groceryTypes = append(groceryTypes, product.GroceryType)
+	if err := validateProductChanges(app.taxonomy, changes); err != nil {
+		return product{}, err
 	}
-	filter := bson.D{{"_id", bson.D{{"$eq", farmerObjectId}}}}
-	update := bson.D{{"$addToSet", bson.D{{"groceryTypes", bson.D{{"$each", groceryTypes}}}}}}
-	collFarmers := client.Database("shopGreenDB").Collection("farmers")
-	_, err = collFarmers.UpdateOne(ctx, filter, update)
+	// products cannot move to another farmer
+	changes.MongoDbID = primitive.ObjectID{}
+	changes.MongoDbFarmerID = primitive.ObjectID{}
+
+	result, err := app.products.Update(productObjectId, changes)
 	if err != nil {
-		return products, err
+		return product{}, err
 	}
+	result.ID = toJsonProductId(result.MongoDbID)
+	result.FarmerID = toJsonFarmerId(result.MongoDbFarmerID)
+	return result, nil
+}
 
-	return products, nil
+// deleteProduct removes the product and recomputes the farmer's grocery types.
+func (app *app) deleteProduct(productId string) error {
+	productObjectId, err := fromJsonProductId(productId)
+	if err != nil {
+		return err
+	}
+	return app.products.Delete(productObjectId)
 }
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ProductRepository stores products. Every change to a farmer's products
+// recomputes the farmer's grocery types from the products they offer.
+type ProductRepository interface {
+	// ByFarmer returns all products of the farmer.
+	ByFarmer(farmerId primitive.ObjectID) ([]product, error)
+	// Get returns the product or errProductNotFound.
+	Get(id primitive.ObjectID) (product, error)
+	// Insert stores new products of the farmer and returns them with their
+	// ids set, or returns errFarmerNotFound if there is no such farmer.
+	Insert(farmerId primitive.ObjectID, products []product) ([]product, error)
+	// Update applies the non-empty fields of changes, merging the fields of
+	// price one by one, and returns the updated product.
+	Update(id primitive.ObjectID, changes product) (product, error)
+	// Delete removes the product.
+	Delete(id primitive.ObjectID) error
+	// RebuildGroceryTypes recomputes the grocery types of every farmer and
+	// returns the number of farmers changed.
+	RebuildGroceryTypes() (int64, error)
+	// GroceryTypes counts the products per grocery type.
+	GroceryTypes() (map[string]int64, error)
+	// RenameGroceryType changes the grocery type of the products of grocery
+	// type from to to and returns the number of products changed. The
+	// grocery types of the farmers are left to RebuildGroceryTypes.
+	RenameGroceryType(from string, to string) (int64, error)
+	// Search returns the products of the farmers within the price bounds of
+	// the search. The text is left to the caller, see matchProductsByText.
+	Search(farmerIds []primitive.ObjectID, search productSearch) ([]productSearchResult, error)
+}
+
+// productPatchSubdocuments are merged field by field on PATCH, all other
+// fields are replaced as a whole.
+var productPatchSubdocuments = []string{"price"}
+
+// mongoProductRepository keeps products in the `products` collection.
+type mongoProductRepository struct{}
+
+// recomputeFarmerGroceryTypes sets the farmer's grocery types to the distinct
+// grocery types of the products they currently offer.
+func recomputeFarmerGroceryTypes(ctx context.Context, db *mongo.Database, farmerObjectId primitive.ObjectID) error {
+	filter := bson.D{{"farmerId", bson.D{{"$eq", farmerObjectId}}}}
+	values, err := db.Collection("products").Distinct(ctx, "groceryType", filter)
+	if err != nil {
+		return err
+	}
+	groceryTypes := make([]string, 0, len(values))
+	for _, value := range values {
+		if groceryType, ok := value.(string); ok && len(groceryType) > 0 {
+			groceryTypes = append(groceryTypes, groceryType)
+		}
+	}
+	sort.Strings(groceryTypes)
+
+	filter = bson.D{{"_id", bson.D{{"$eq", farmerObjectId}}}}
+	update := bson.D{{"$set", bson.D{{"groceryTypes", groceryTypes}}}}
+	_, err = db.Collection("farmers").UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (mongoProductRepository) ByFarmer(farmerObjectId primitive.ObjectID) ([]product, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("products")
+
+	filter := bson.D{{"farmerId", bson.D{{"$eq", farmerObjectId}}}}
+	// sort := bson.D{{"date_ordered", 1}}
+	opts := options.Find() //.SetSort(sort)
+
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []product = make([]product, 0)
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (mongoProductRepository) Get(productObjectId primitive.ObjectID) (product, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return product{}, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("products")
+	filter := bson.D{{"_id", bson.D{{"$eq", productObjectId}}}}
+	var result product
+	err = coll.FindOne(ctx, filter).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return product{}, errProductNotFound
+	}
+	if err != nil {
+		return product{}, err
+	}
+	return result, nil
+}
+
+func (mongoProductRepository) Insert(farmerObjectId primitive.ObjectID, products []product) ([]product, error) {
+	for i := range products {
+		products[i].MongoDbID = primitive.ObjectID{}
+		products[i].MongoDbFarmerID = farmerObjectId
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return products, err
+	}
+
+	// Insert products and update the farmer's grocery types in one
+	// transaction, so that a failure cannot leave products behind whose grocery
+	// types the farmer does not list
+	db := client.Database("shopGreenDB")
+	var insertedIds []interface{}
+	err = withMongoTransaction(ctx, client, func(ctx mongo.SessionContext) error {
+		filter := bson.D{{"_id", bson.D{{"$eq", farmerObjectId}}}}
+		count, err := db.Collection("farmers").CountDocuments(ctx, filter, options.Count().SetLimit(1))
+		if err != nil {
+			return err
+		}
+		if count <= 0 {
+			return errFarmerNotFound
+		}
+
+		documents := make([]interface{}, 0)
+		for _, product := range products {
+			documents = append(documents, product)
+		}
+		result, err := db.Collection("products").InsertMany(ctx, documents)
+		if err != nil {
+			return err
+		}
+		if len(result.InsertedIDs) != len(products) {
+			return fmt.Errorf("Expected %d inserted ids, got %d", len(products), len(result.InsertedIDs))
+		}
+		insertedIds = result.InsertedIDs
+
+		// recompute the farmer's grocery types to include the new products' grocery types
+		return recomputeFarmerGroceryTypes(ctx, db, farmerObjectId)
+	})
+	if err != nil {
+		return products, err
+	}
+	for i := range products {
+		products[i].MongoDbID = insertedIds[i].(primitive.ObjectID)
+	}
+
+	return products, nil
+}
+
+func (mongoProductRepository) Update(productObjectId primitive.ObjectID, changes product) (product, error) {
+	patch, err := toMongoPatch(changes, productPatchSubdocuments)
+	if err != nil {
+		return product{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return product{}, err
+	}
+
+	db := client.Database("shopGreenDB")
+	filter := bson.D{{"_id", bson.D{{"$eq", productObjectId}}}}
+	var result product
+	if len(patch) <= 0 {
+		err = db.Collection("products").FindOne(ctx, filter).Decode(&result)
+	} else {
+		// update the product and the farmer's grocery types in one
+		// transaction like Insert
+		err = withMongoTransaction(ctx, client, func(ctx mongo.SessionContext) error {
+			update := bson.D{{"$set", patch}}
+			opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+			err := db.Collection("products").FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+			if err != nil || len(changes.GroceryType) <= 0 {
+				return err
+			}
+			return recomputeFarmerGroceryTypes(ctx, db, result.MongoDbFarmerID)
+		})
+	}
+	if err == mongo.ErrNoDocuments {
+		return product{}, errProductNotFound
+	}
+	if err != nil {
+		return product{}, err
+	}
+	return result, nil
+}
+
+func (mongoProductRepository) Delete(productObjectId primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	db := client.Database("shopGreenDB")
+	filter := bson.D{{"_id", bson.D{{"$eq", productObjectId}}}}
+	err = withMongoTransaction(ctx, client, func(ctx mongo.SessionContext) error {
+		var deleted product
+		err := db.Collection("products").FindOneAndDelete(ctx, filter).Decode(&deleted)
+		if err != nil {
+			return err
+		}
+		return recomputeFarmerGroceryTypes(ctx, db, deleted.MongoDbFarmerID)
+	})
+	if err == mongo.ErrNoDocuments {
+		return errProductNotFound
+	}
+	return err
+}
+
+func (mongoProductRepository) RebuildGroceryTypes() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	db := client.Database("shopGreenDB")
+	pipeline := mongo.Pipeline{
+		{{"$group", bson.D{
+			{"_id", "$farmerId"},
+			{"groceryTypes", bson.D{{"$addToSet", "$groceryType"}}},
+		}}},
+	}
+	cursor, err := db.Collection("products").Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	var groups []struct {
+		FarmerID     primitive.ObjectID `bson:"_id"`
+		GroceryTypes []string           `bson:"groceryTypes"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return 0, err
+	}
+	groceryTypesByFarmer := make(map[primitive.ObjectID][]string)
+	for _, group := range groups {
+		groceryTypes := make([]string, 0, len(group.GroceryTypes))
+		for _, groceryType := range group.GroceryTypes {
+			if len(groceryType) > 0 {
+				groceryTypes = append(groceryTypes, groceryType)
+			}
+		}
+		sort.Strings(groceryTypes)
+		groceryTypesByFarmer[group.FarmerID] = groceryTypes
+	}
+
+	// every farmer is updated, so that farmers without products end up with
+	// no grocery types at all
+	opts := options.Find().SetProjection(bson.D{{"_id", 1}})
+	cursor, err = db.Collection("farmers").Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return 0, err
+	}
+	var farmers []farmer
+	if err = cursor.All(ctx, &farmers); err != nil {
+		return 0, err
+	}
+	if len(farmers) <= 0 {
+		return 0, nil
+	}
+	models := make([]mongo.WriteModel, 0, len(farmers))
+	for _, farmer := range farmers {
+		groceryTypes, ok := groceryTypesByFarmer[farmer.MongoDbID]
+		if !ok {
+			groceryTypes = make([]string, 0)
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{"_id", bson.D{{"$eq", farmer.MongoDbID}}}}).
+			SetUpdate(bson.D{{"$set", bson.D{{"groceryTypes", groceryTypes}}}}))
+	}
+	result, err := db.Collection("farmers").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (mongoProductRepository) GroceryTypes() (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"groceryType", bson.D{{"$exists", true}}}}}},
+		{{"$group", bson.D{
+			{"_id", "$groceryType"},
+			{"count", bson.D{{"$sum", 1}}},
+		}}},
+	}
+	cursor, err := client.Database("shopGreenDB").Collection("products").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		GroceryType string `bson:"_id"`
+		Count       int64  `bson:"count"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(groups))
+	for _, group := range groups {
+		if len(group.GroceryType) > 0 {
+			counts[group.GroceryType] = group.Count
+		}
+	}
+	return counts, nil
+}
+
+func (mongoProductRepository) RenameGroceryType(from string, to string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	filter := bson.D{{"groceryType", bson.D{{"$eq", from}}}}
+	update := bson.D{{"$set", bson.D{{"groceryType", to}}}}
+	result, err := client.Database("shopGreenDB").Collection("products").UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (mongoProductRepository) Search(farmerObjectIds []primitive.ObjectID, search productSearch) ([]productSearchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongoClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	coll := client.Database("shopGreenDB").Collection("products")
+	conditions := bson.A{
+		bson.D{{"farmerId", bson.D{{"$in", farmerObjectIds}}}},
+		search.priceFilter(),
+	}
+	cursor, err := coll.Find(ctx, bson.D{{"$and", conditions}})
+	if err != nil {
+		return nil, err
+	}
+	results := make([]productSearchResult, 0)
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
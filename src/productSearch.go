@@ -0,0 +1,215 @@
+package main
+
+import (
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/maps"
+)
+
+// productSearch narrows down the products of the farmers near a shopper.
+type productSearch struct {
+	// Text is matched against the name and description, tolerating typos
+	// and diacritics like the farmer search; empty matches all
+	Text string
+	// MinPrice and MaxPrice bound the price per PriceUnit, nil if unbounded
+	MinPrice *float64
+	MaxPrice *float64
+	// PriceUnit is the unit the bounds are given per. Products priced per a
+	// convertible unit, e.g. g for kg, are compared after conversion; others
+	// do not match. If empty, the bounds apply to the prices as they are.
+	PriceUnit string
+}
+
+// productSearchResult is a product found near the shopper together with its
+// farmer and their distance.
+type productSearchResult struct {
+	product     `bson:",inline"`
+	Farmer      farmer  `bson:"-" json:"farmer"`
+	Distance_km float64 `bson:"-" json:"distance_km"`
+	// Score rates how well the product matches the text, higher is better
+	Score float64 `bson:"-" json:"-"`
+}
+
+const (
+	productSortRelevance = "relevance"
+	productSortDistance  = "distance"
+	productSortPrice     = "price"
+)
+
+func isValidProductSort(sortBy string) bool {
+	return sortBy == productSortRelevance || sortBy == productSortDistance || sortBy == productSortPrice
+}
+
+// priceUnitQuantities relates units of the same dimension by their size in a
+// common base unit, so that prices can be converted between them.
+var priceUnitQuantities = map[string]struct {
+	Dimension string
+	Size      float64
+}{
+	"piece": {"count", 1},
+	"dozen": {"count", 12},
+	"g":     {"mass", 1},
+	"kg":    {"mass", 1000},
+	"ml":    {"volume", 1},
+	"l":     {"volume", 1000},
+}
+
+// priceFactors returns the units whose prices can be compared per unit, each
+// with the factor that converts a price per that unit into a price per unit.
+func priceFactors(unit string) map[string]float64 {
+	quantity, ok := priceUnitQuantities[unit]
+	if !ok {
+		// e.g. bunch, which only compares to itself
+		return map[string]float64{unit: 1}
+	}
+	factors := make(map[string]float64)
+	for other, otherQuantity := range priceUnitQuantities {
+		if otherQuantity.Dimension == quantity.Dimension {
+			factors[other] = quantity.Size / otherQuantity.Size
+		}
+	}
+	return factors
+}
+
+// unitPrice returns the price of p per the search's price unit, and false if
+// it cannot be converted.
+func (search productSearch) unitPrice(p price) (float64, bool) {
+	if len(search.PriceUnit) <= 0 {
+		return float64(p.Value), true
+	}
+	factor, ok := priceFactors(search.PriceUnit)[p.PerUnit]
+	return float64(p.Value) * factor, ok
+}
+
+func (search productSearch) hasPriceFilter() bool {
+	return search.MinPrice != nil || search.MaxPrice != nil || len(search.PriceUnit) > 0
+}
+
+// matchesPrice reports whether the price lies within the bounds.
+func (search productSearch) matchesPrice(p price) bool {
+	value, ok := search.unitPrice(p)
+	if !ok {
+		return false
+	}
+	return (search.MinPrice == nil || value >= *search.MinPrice) && (search.MaxPrice == nil || value <= *search.MaxPrice)
+}
+
+// priceFilter returns the MongoDB query equivalent of matchesPrice, with one
+// branch per convertible unit.
+func (search productSearch) priceFilter() bson.D {
+	if !search.hasPriceFilter() {
+		return bson.D{}
+	}
+	factors := map[string]float64{"": 1}
+	if len(search.PriceUnit) > 0 {
+		factors = priceFactors(search.PriceUnit)
+	}
+	units := maps.Keys(factors)
+	sort.Strings(units)
+	branches := bson.A{}
+	for _, unit := range units {
+		bounds := bson.D{}
+		if search.MinPrice != nil {
+			bounds = append(bounds, bson.E{"$gte", *search.MinPrice / factors[unit]})
+		}
+		if search.MaxPrice != nil {
+			bounds = append(bounds, bson.E{"$lte", *search.MaxPrice / factors[unit]})
+		}
+		branch := bson.D{}
+		if len(unit) > 0 {
+			branch = append(branch, bson.E{"price.perUnit", unit})
+		}
+		if len(bounds) > 0 {
+			branch = append(branch, bson.E{"price.value", bounds})
+		}
+		branches = append(branches, branch)
+	}
+	return bson.D{{"$or", branches}}
+}
+
+// weight of the name relative to the description in text search
+const productNameWeight = 3
+
+// matchProductsByText returns the results whose name or description match
+// every term of text, with their score set, using the same in-process text
+// index as matchFarmersByText.
+func matchProductsByText(results []productSearchResult, text string) []productSearchResult {
+	index := newTextIndex()
+	for i, result := range results {
+		index.add(i, result.Name, productNameWeight)
+		index.add(i, result.Description, 1)
+	}
+	scores := index.search(text)
+	matched := make([]productSearchResult, 0, len(scores))
+	for i, result := range results {
+		if score, ok := scores[i]; ok {
+			result.Score = score
+			matched = append(matched, result)
+		}
+	}
+	return matched
+}
+
+// sortProductSearchResults orders results by decreasing score, increasing
+// distance or increasing price per the search's unit. Ties are broken by
+// distance and then by id so that pages of a result are stable.
+func sortProductSearchResults(results []productSearchResult, search productSearch, sortBy string) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		switch sortBy {
+		case productSortRelevance:
+			if a.Score != b.Score {
+				return a.Score > b.Score
+			}
+		case productSortPrice:
+			priceA, _ := search.unitPrice(a.Price)
+			priceB, _ := search.unitPrice(b.Price)
+			if priceA != priceB {
+				return priceA < priceB
+			}
+		}
+		if a.Distance_km != b.Distance_km {
+			return a.Distance_km < b.Distance_km
+		}
+		return a.ID < b.ID
+	})
+}
+
+// findProductsNearBy returns the products of the verified farmers within
+// maxDistance_km of point that match the search.
+func (app *app) findProductsNearBy(point geoLocation, maxDistance_km float64, search productSearch, sortBy string) ([]productSearchResult, error) {
+	farmers, err := app.getFarmersNearBy(point, maxDistance_km, "", farmerFilter{}, nil, farmerSortDistance)
+	if err != nil {
+		return nil, err
+	}
+	farmersById := make(map[primitive.ObjectID]farmer, len(farmers))
+	for _, farmer := range farmers {
+		// the search only finds verified farmers, check anyway as shoppers
+		// must never see the products of others
+		if farmer.isVerified() {
+			farmersById[farmer.MongoDbID] = farmer
+		}
+	}
+	if len(farmersById) <= 0 {
+		return make([]productSearchResult, 0), nil
+	}
+
+	results, err := app.products.Search(maps.Keys(farmersById), search)
+	if err != nil {
+		return nil, err
+	}
+	if len(searchTerms(search.Text)) > 0 {
+		results = matchProductsByText(results, search.Text)
+	}
+	for i, result := range results {
+		farmer := farmersById[result.MongoDbFarmerID]
+		results[i].ID = toJsonProductId(result.MongoDbID)
+		results[i].FarmerID = toJsonFarmerId(result.MongoDbFarmerID)
+		results[i].Farmer = farmer
+		results[i].Distance_km = farmer.Distance_km
+	}
+	sortProductSearchResults(results, search, sortBy)
+	return results, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// locations closer than this many degrees are considered equal, roughly a
+// centimeter, to tolerate rounding in the geo index
+const reconcileLocationTolerance = 1e-7
+
+type geoIndexDiscrepancy struct {
+	// Kind is "missing" (in MongoDB but not in the geo index), "orphan" (in
+	// the geo index but not in MongoDB) or "stale" (at a different location)
+	Kind          string
+	FarmerID      string
+	MongoLocation geoLocation
+	IndexLocation geoLocation
+}
+
+func (d geoIndexDiscrepancy) String() string {
+	switch d.Kind {
+	case "missing":
+		return fmt.Sprintf("missing %s: at (%.7f, %.7f) in MongoDB but not in the geo index",
+			d.FarmerID, d.MongoLocation.Longitude, d.MongoLocation.Latitude)
+	case "orphan":
+		return fmt.Sprintf("orphan  %s: at (%.7f, %.7f) in the geo index but not in MongoDB",
+			d.FarmerID, d.IndexLocation.Longitude, d.IndexLocation.Latitude)
+	default:
+		return fmt.Sprintf("stale   %s: at (%.7f, %.7f) in MongoDB but at (%.7f, %.7f) in the geo index",
+			d.FarmerID, d.MongoLocation.Longitude, d.MongoLocation.Latitude, d.IndexLocation.Longitude, d.IndexLocation.Latitude)
+	}
+}
+
+func sameLocation(a geoLocation, b geoLocation) bool {
+	return math.Abs(a.Longitude-b.Longitude) <= reconcileLocationTolerance &&
+		math.Abs(a.Latitude-b.Latitude) <= reconcileLocationTolerance
+}
+
+// findGeoIndexDiscrepancies diffs the farmers in MongoDB against the geo index
+// by id and location. Farmers with a pending outbox entry are skipped, since
+// the outbox is already going to converge them.
+func (app *app) findGeoIndexDiscrepancies() ([]geoIndexDiscrepancy, error) {
+	mongoLocations, err := app.farmers.Locations()
+	if err != nil {
+		return nil, err
+	}
+	pending, err := app.outbox.FarmerIDs()
+	if err != nil {
+		return nil, err
+	}
+	indexLocations, err := app.geoIndex.All()
+	if err != nil {
+		return nil, err
+	}
+
+	discrepancies := make([]geoIndexDiscrepancy, 0)
+	for id, mongoLocation := range mongoLocations {
+		if pending[id] {
+			continue
+		}
+		indexLocation, ok := indexLocations[id]
+		if !ok {
+			discrepancies = append(discrepancies, geoIndexDiscrepancy{Kind: "missing", FarmerID: id, MongoLocation: mongoLocation})
+		} else if !sameLocation(mongoLocation, indexLocation) {
+			discrepancies = append(discrepancies, geoIndexDiscrepancy{Kind: "stale", FarmerID: id, MongoLocation: mongoLocation, IndexLocation: indexLocation})
+		}
+	}
+	for id, indexLocation := range indexLocations {
+		if _, ok := mongoLocations[id]; !ok && !pending[id] {
+			discrepancies = append(discrepancies, geoIndexDiscrepancy{Kind: "orphan", FarmerID: id, IndexLocation: indexLocation})
+		}
+	}
+	sort.Slice(discrepancies, func(i, j int) bool {
+		return discrepancies[i].FarmerID < discrepancies[j].FarmerID
+	})
+	return discrepancies, nil
+}
+
+func (app *app) repairGeoIndexDiscrepancy(d geoIndexDiscrepancy) error {
+	if d.Kind == "orphan" {
+		return app.geoIndex.Delete(d.FarmerID)
+	}
+	return app.geoIndex.Insert(d.FarmerID, d.MongoLocation)
+}
+
+// reconcileGeoIndex reports the discrepancies between MongoDB and the geo
+// index to out and, unless dryRun is set, repairs them. It returns the number
+// of discrepancies left unrepaired.
+func (app *app) reconcileGeoIndex(dryRun bool, out io.Writer) (int, error) {
+	discrepancies, err := app.findGeoIndexDiscrepancies()
+	if err != nil {
+		return 0, err
+	}
+
+	unrepaired := 0
+	for _, d := range discrepancies {
+		if dryRun {
+			fmt.Fprintln(out, d)
+			unrepaired++
+			continue
+		}
+		if err := app.repairGeoIndexDiscrepancy(d); err != nil {
+			fmt.Fprintf(out, "%s (repair failed: %s)\n", d, err)
+			unrepaired++
+			continue
+		}
+		fmt.Fprintf(out, "%s (repaired)\n", d)
+	}
+	if dryRun {
+		fmt.Fprintf(out, "%d discrepancies found (dry run, nothing repaired)\n", len(discrepancies))
+	} else {
+		fmt.Fprintf(out, "%d discrepancies found, %d repaired\n", len(discrepancies), len(discrepancies)-unrepaired)
+	}
+	return unrepaired, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/text/language"
+)
+
+// The taxonomy is the controlled vocabulary of grocery types and features.
+// Grocery types form a tree, e.g. dairy > cheese > goat-cheese, features a
+// flat catalogue. Terms are stored by id; on writes, labels in any language
+// and synonyms are normalized to the id, and anything else is rejected.
+//
+//go:embed data/taxonomy.json
+var taxonomyJson []byte
+
+// languages labels are available in, the first is the fallback
+var taxonomyLanguages = []language.Tag{language.English, language.German}
+
+var taxonomyLanguageMatcher = language.NewMatcher(taxonomyLanguages)
+
+// taxonomyTerm is a grocery type or feature.
+type taxonomyTerm struct {
+	ID string `json:"id"`
+	// Labels by language code
+	Labels map[string]string `json:"labels"`
+	// Synonyms are further names the term is recognized by
+	Synonyms []string        `json:"synonyms,omitempty"`
+	Children []*taxonomyTerm `json:"children,omitempty"`
+}
+
+type taxonomy struct {
+	GroceryTypes []*taxonomyTerm `json:"groceryTypes"`
+	Features     []*taxonomyTerm `json:"features"`
+	// ids by folded id, label and synonym
+	groceryTypeIds map[string]string
+	featureIds     map[string]string
+	// ids by the singular or plural of their folded id and English label,
+	// unless that is a name of its own
+	groceryTypeInflections map[string]string
+	featureInflections     map[string]string
+	// parent ids of grocery types, empty for the top level
+	groceryTypeParents map[string]string
+}
+
+// newTaxonomy reads a taxonomy from JSON and checks that no name refers to
+// more than one term.
+func newTaxonomy(b []byte) (*taxonomy, error) {
+	var t taxonomy
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("Invalid taxonomy: %s", err)
+	}
+	t.groceryTypeIds = make(map[string]string)
+	t.featureIds = make(map[string]string)
+	t.groceryTypeParents = make(map[string]string)
+	if err := indexTerms(t.GroceryTypes, "", t.groceryTypeIds, t.groceryTypeParents); err != nil {
+		return nil, err
+	}
+	if err := indexTerms(t.Features, "", t.featureIds, nil); err != nil {
+		return nil, err
+	}
+	t.groceryTypeInflections = make(map[string]string)
+	t.featureInflections = make(map[string]string)
+	indexInflections(t.GroceryTypes, t.groceryTypeIds, t.groceryTypeInflections)
+	indexInflections(t.Features, t.featureIds, t.featureInflections)
+	return &t, nil
+}
+
+// indexTerms adds the names of the terms and their descendants to ids and,
+// unless it is nil, their parents to parents. Only grocery types form a tree,
+// features must not have children.
+func indexTerms(terms []*taxonomyTerm, parent string, ids map[string]string, parents map[string]string) error {
+	for _, term := range terms {
+		if len(term.ID) <= 0 || term.ID != taxonomyId(term.ID) {
+			return fmt.Errorf("Invalid taxonomy, the id '%s' must be lower case words joined by hyphens", term.ID)
+		}
+		if _, ok := ids[taxonomyKey(term.ID)]; ok {
+			return fmt.Errorf("Invalid taxonomy, the id %s is used twice", term.ID)
+		}
+		names := append([]string{term.ID}, term.Synonyms...)
+		for _, label := range term.Labels {
+			names = append(names, label)
+		}
+		for _, name := range names {
+			key := taxonomyKey(name)
+			if other, ok := ids[key]; ok && other != term.ID {
+				return fmt.Errorf("Invalid taxonomy, '%s' names both %s and %s", name, other, term.ID)
+			}
+			ids[key] = term.ID
+		}
+		if parents == nil {
+			if len(term.Children) > 0 {
+				return fmt.Errorf("Invalid taxonomy, the feature %s has children", term.ID)
+			}
+			continue
+		}
+		parents[term.ID] = parent
+		if err := indexTerms(term.Children, term.ID, ids, parents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexInflections adds the singular or plural of the ids and English labels
+// of the terms and their descendants to inflections, unless ids has them as
+// a name already. Labels of other languages and synonyms are not inflected,
+// since English rules would turn them into other words, e.g. "Ei" into "Eis".
+func indexInflections(terms []*taxonomyTerm, ids map[string]string, inflections map[string]string) {
+	for _, term := range terms {
+		for _, name := range []string{term.ID, term.Labels[taxonomyLanguages[0].String()]} {
+			for _, inflection := range englishInflections(taxonomyKey(name)) {
+				if _, ok := ids[inflection]; ok {
+					continue
+				}
+				if _, ok := inflections[inflection]; !ok {
+					inflections[inflection] = term.ID
+				}
+			}
+		}
+		indexInflections(term.Children, ids, inflections)
+	}
+}
+
+// englishInflections returns the likely singular of a plural or the plural
+// of a singular English noun, e.g. "tomato" for "tomatoes" and "farm shops"
+// for "farm shop".
+func englishInflections(key string) []string {
+	switch {
+	case len(key) <= 0:
+		return nil
+	case strings.HasSuffix(key, "ies"):
+		return []string{strings.TrimSuffix(key, "ies") + "y"}
+	case strings.HasSuffix(key, "es"):
+		return []string{strings.TrimSuffix(key, "es"), strings.TrimSuffix(key, "s")}
+	case strings.HasSuffix(key, "s"):
+		return []string{strings.TrimSuffix(key, "s")}
+	case strings.HasSuffix(key, "x") || strings.HasSuffix(key, "z") || strings.HasSuffix(key, "ch") || strings.HasSuffix(key, "sh") || strings.HasSuffix(key, "o"):
+		return []string{key + "es"}
+	default:
+		return []string{key + "s"}
+	}
+}
+
+// taxonomyId returns the id a term with the name would have.
+func taxonomyId(name string) string {
+	return strings.Join(searchTerms(name), "-")
+}
+
+// taxonomyKey folds a name so that case, diacritics and punctuation do not
+// matter, e.g. "Goat-Cheese" and "goat cheese".
+func taxonomyKey(name string) string {
+	return strings.Join(searchTerms(name), " ")
+}
+
+// lookup returns the id of the term with the name, or else of the term it is
+// an inflection of.
+func lookup(ids map[string]string, inflections map[string]string, name string) (string, bool) {
+	key := taxonomyKey(name)
+	if id, ok := ids[key]; ok {
+		return id, true
+	}
+	id, ok := inflections[key]
+	return id, ok
+}
+
+// groceryTypeId returns the id of the grocery type with the name.
+func (t *taxonomy) groceryTypeId(name string) (string, bool) {
+	return lookup(t.groceryTypeIds, t.groceryTypeInflections, name)
+}
+
+// featureId returns the id of the feature with the name.
+func (t *taxonomy) featureId(name string) (string, bool) {
+	return lookup(t.featureIds, t.featureInflections, name)
+}
+
+// isGroceryType reports whether id is the id of a grocery type.
+func (t *taxonomy) isGroceryType(id string) bool {
+	_, ok := t.groceryTypeParents[id]
+	return ok
+}
+
+// isFeature reports whether id is the id of a feature.
+func (t *taxonomy) isFeature(id string) bool {
+	return t.featureIds[taxonomyKey(id)] == id
+}
+
+// normalizeGroceryType returns the id of the grocery type with the name, or
+// name itself if there is none, so that validation can report it.
+func (t *taxonomy) normalizeGroceryType(name string) string {
+	if id, ok := t.groceryTypeId(name); ok {
+		return id
+	}
+	return name
+}
+
+// normalizeFeatures replaces the names of features by their ids and drops
+// names that turn out to be duplicates. Unknown names are kept, so that
+// validation can report them.
+func (t *taxonomy) normalizeFeatures(names []string) []string {
+	if names == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		id, ok := t.featureId(name)
+		if !ok {
+			id = name
+		}
+		if !seen[id] || !ok {
+			ids = append(ids, id)
+		}
+		seen[id] = true
+	}
+	return ids
+}
+
+// groceryTypePath returns the ids from the top level category down to the
+// grocery type, e.g. dairy, cheese, goat-cheese. Unknown grocery types stand
+// on their own.
+func (t *taxonomy) groceryTypePath(id string) []string {
+	path := []string{id}
+	for parent := t.groceryTypeParents[id]; len(parent) > 0; parent = t.groceryTypeParents[parent] {
+		path = append([]string{parent}, path...)
+	}
+	return path
+}
+
+// expandGroceryType returns the id of the grocery type with the name and the
+// ids of all its descendants. The name itself is kept, so that grocery types
+// stored before the taxonomy still match.
+func (t *taxonomy) expandGroceryType(name string) []string {
+	tags := []string{name}
+	id, ok := t.groceryTypeId(name)
+	if !ok {
+		return tags
+	}
+	for other := range t.groceryTypeParents {
+		if other != name && slices.Contains(t.groceryTypePath(other), id) {
+			tags = append(tags, other)
+		}
+	}
+	sort.Strings(tags[1:])
+	return tags
+}
+
+// expandFeature returns the id of the feature with the name, keeping the name
+// like expandGroceryType.
+func (t *taxonomy) expandFeature(name string) []string {
+	if id, ok := t.featureId(name); ok && id != name {
+		return []string{name, id}
+	}
+	return []string{name}
+}
+
+// groceryTypeMatch explains why a farmer matched a grocery type filter.
+type groceryTypeMatch struct {
+	// Filter is the grocery type filtered by, normalized to its id
+	Filter string `json:"filter"`
+	// Path leads from the top level category to the farmer's grocery type
+	// that matched
+	Path []string `json:"path"`
+}
+
+// matchGroceryTypes returns which of the grocery types each requested grocery
+// type matched.
+func (t *taxonomy) matchGroceryTypes(requested []string, groceryTypes []string) []groceryTypeMatch {
+	matches := make([]groceryTypeMatch, 0)
+	for _, filter := range requested {
+		expanded := t.expandGroceryType(filter)
+		if id, ok := t.groceryTypeId(filter); ok {
+			filter = id
+		}
+		for _, groceryType := range groceryTypes {
+			if slices.Contains(expanded, groceryType) {
+				matches = append(matches, groceryTypeMatch{Filter: filter, Path: t.groceryTypePath(groceryType)})
+			}
+		}
+	}
+	return matches
+}
+
+// localizedTerm is a term as served to clients, labeled in one language.
+type localizedTerm struct {
+	ID       string          `json:"id"`
+	Label    string          `json:"label"`
+	Children []localizedTerm `json:"children,omitempty"`
+}
+
+// localize returns the terms labeled in the language, falling back to
+// English for missing labels.
+func localize(terms []*taxonomyTerm, lang string) []localizedTerm {
+	localized := make([]localizedTerm, 0, len(terms))
+	for _, term := range terms {
+		label, ok := term.Labels[lang]
+		if !ok {
+			label = term.Labels[taxonomyLanguages[0].String()]
+		}
+		localized = append(localized, localizedTerm{ID: term.ID, Label: label, Children: localize(term.Children, lang)})
+	}
+	return localized
+}
+
+// taxonomyLanguage picks the language of labels from the lang parameter or,
+// without it, from the Accept-Language header.
+func taxonomyLanguage(lang string, acceptLanguage string) string {
+	preferred := lang
+	if len(preferred) <= 0 {
+		preferred = acceptLanguage
+	}
+	tags, _, _ := language.ParseAcceptLanguage(preferred)
+	_, index, _ := taxonomyLanguageMatcher.Match(tags...)
+	return taxonomyLanguages[index].String()
+}
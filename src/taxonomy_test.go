@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func mustNewTaxonomy(t *testing.T) *taxonomy {
+	t.Helper()
+	taxonomy, err := newTaxonomy(taxonomyJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return taxonomy
+}
+
+func TestGroceryTypeId(t *testing.T) {
+	taxonomy := mustNewTaxonomy(t)
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"goat-cheese", "goat-cheese"},
+		{"Goat Cheese", "goat-cheese"},
+		{"Ziegenkäse", "goat-cheese"},
+		{"ziegenkase", "goat-cheese"},
+		{"chevre", "goat-cheese"},
+		// singular and plural of ids and English labels
+		{"egg", "eggs"},
+		{"tomato", "tomatoes"},
+		{"berry", "berries"},
+		{"Sausage", "sausages"},
+	}
+	for _, test := range tests {
+		if got, ok := taxonomy.groceryTypeId(test.name); !ok || got != test.want {
+			t.Errorf("groceryTypeId(%s) = %s, %v, expected %s", test.name, got, ok, test.want)
+		}
+	}
+
+	// German labels are not inflected, "Eis" is ice cream rather than "Ei"
+	for _, name := range []string{"Eis", "Tomatens", "caviar"} {
+		if id, ok := taxonomy.groceryTypeId(name); ok {
+			t.Errorf("groceryTypeId(%s) = %s, expected no grocery type", name, id)
+		}
+	}
+}
+
+func TestFeatureId(t *testing.T) {
+	taxonomy := mustNewTaxonomy(t)
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Hofladen", "farm-shop"},
+		{"farm shops", "farm-shop"},
+		{"Bio", "organic"},
+	}
+	for _, test := range tests {
+		if got, ok := taxonomy.featureId(test.name); !ok || got != test.want {
+			t.Errorf("featureId(%s) = %s, %v, expected %s", test.name, got, ok, test.want)
+		}
+	}
+}
+
+func TestGroceryTypePath(t *testing.T) {
+	taxonomy := mustNewTaxonomy(t)
+	tests := []struct {
+		id   string
+		want []string
+	}{
+		{"dairy", []string{"dairy"}},
+		{"cheese", []string{"dairy", "cheese"}},
+		{"goat-cheese", []string{"dairy", "cheese", "goat-cheese"}},
+		{"unknown", []string{"unknown"}},
+	}
+	for _, test := range tests {
+		if got := taxonomy.groceryTypePath(test.id); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("groceryTypePath(%s) = %v, expected %v", test.id, got, test.want)
+		}
+	}
+}
+
+func TestExpandGroceryType(t *testing.T) {
+	taxonomy := mustNewTaxonomy(t)
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"cheese", []string{"cheese", "cow-cheese", "goat-cheese", "sheep-cheese"}},
+		{"Käse", []string{"Käse", "cheese", "cow-cheese", "goat-cheese", "sheep-cheese"}},
+		{"goat-cheese", []string{"goat-cheese"}},
+		{"chevre", []string{"chevre", "goat-cheese"}},
+		{"unknown", []string{"unknown"}},
+	}
+	for _, test := range tests {
+		if got := taxonomy.expandGroceryType(test.name); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("expandGroceryType(%s) = %v, expected %v", test.name, got, test.want)
+		}
+	}
+
+	dairy := taxonomy.expandGroceryType("dairy")
+	for _, id := range []string{"dairy", "milk", "cheese", "goat-cheese", "yogurt", "butter"} {
+		if !slices.Contains(dairy, id) {
+			t.Errorf("Expected dairy to include %s, got %v", id, dairy)
+		}
+	}
+	if slices.Contains(dairy, "eggs") {
+		t.Errorf("Expected dairy not to include eggs, got %v", dairy)
+	}
+}
+
+func TestMatchGroceryTypes(t *testing.T) {
+	taxonomy := mustNewTaxonomy(t)
+	got := taxonomy.matchGroceryTypes([]string{"Käse", "honey", "fish"}, []string{"goat-cheese", "sheep-cheese", "honey"})
+	want := []groceryTypeMatch{
+		{Filter: "cheese", Path: []string{"dairy", "cheese", "goat-cheese"}},
+		{Filter: "cheese", Path: []string{"dairy", "cheese", "sheep-cheese"}},
+		{Filter: "honey", Path: []string{"honey"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestParseFarmerFilterExpandsSubtrees(t *testing.T) {
+	taxonomy := mustNewTaxonomy(t)
+	filter := parseFarmerFilter(url.Values{
+		"filter_groceryTypes":      {"cheese"},
+		"filter_groceryTypes_none": {"meat"},
+	}, taxonomy)
+	tests := []struct {
+		groceryTypes []string
+		want         bool
+	}{
+		{[]string{"goat-cheese"}, true},
+		{[]string{"cheese", "milk"}, true},
+		{[]string{"milk"}, false},
+		{[]string{"goat-cheese", "poultry"}, false},
+	}
+	for _, test := range tests {
+		if got := filter.matches(farmer{GroceryTypes: test.groceryTypes}); got != test.want {
+			t.Errorf("matches(%v) = %v, expected %v", test.groceryTypes, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Text search runs in process over the candidates of a geo query, which keeps
+// it independent of the repository and the geo index and allows for typos,
+// which MongoDB's text indexes do not.
+
+// letters that do not decompose into a base letter and a diacritic
+var foldedLetters = strings.NewReplacer("ß", "ss", "æ", "ae", "œ", "oe", "ø", "o", "ł", "l", "đ", "d", "ı", "i")
+
+// foldText lower cases s and strips diacritics, so that "Müller" and
+// "muller" compare equal.
+func foldText(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, strings.ToLower(s))
+	if err != nil {
+		folded = strings.ToLower(s)
+	}
+	return foldedLetters.Replace(folded)
+}
+
+// searchTerms splits text into folded words.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(foldText(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// maxTypos returns the number of typos tolerated in a term, more for longer
+// terms, none for short ones where a typo makes a different word.
+func maxTypos(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// editDistance returns the number of insertions, deletions, substitutions
+// and transpositions of adjacent letters turning a into b, or max+1 if it is
+// greater than max.
+func editDistance(a string, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	if abs(len(ra)-len(rb)) > max {
+		return max + 1
+	}
+	// rows i-2, i-1 and i of the optimal string alignment matrix
+	previous2 := make([]int, len(rb)+1)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		rowMin := current[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d := minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d = minInt(d, previous2[j-2]+1)
+			}
+			current[j] = d
+			rowMin = minInt(rowMin, d)
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		previous2, previous, current = previous, current, previous2
+	}
+	return minInt(previous[len(rb)], max+1)
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// termSimilarity rates how well a word of a document matches a search term,
+// from 1 for the same word down to 0 for no match. Terms of three letters and
+// more also match the beginning of words, so that results appear while typing.
+func termSimilarity(term string, word string) float64 {
+	if term == word {
+		return 1
+	}
+	if utf8.RuneCountInString(term) >= 3 && strings.HasPrefix(word, term) {
+		return 0.8
+	}
+	max := maxTypos(term)
+	if max <= 0 {
+		return 0
+	}
+	typos := editDistance(term, word, max)
+	if typos > max {
+		return 0
+	}
+	return 0.7 - 0.3*float64(typos-1)
+}
+
+// textIndex is an inverted index mapping words to the documents containing
+// them, with the weight of the most important field they occur in.
+type textIndex struct {
+	postings map[string]map[int]float64
+}
+
+func newTextIndex() *textIndex {
+	return &textIndex{postings: make(map[string]map[int]float64)}
+}
+
+// add indexes the words of text as part of the document with the given
+// number, weighted by the importance of the field the text comes from.
+func (index *textIndex) add(document int, text string, weight float64) {
+	for _, word := range searchTerms(text) {
+		documents, ok := index.postings[word]
+		if !ok {
+			documents = make(map[int]float64)
+			index.postings[word] = documents
+		}
+		if weight > documents[document] {
+			documents[document] = weight
+		}
+	}
+}
+
+// search returns the score of every document matching all terms of query.
+// Each term contributes the weight of its best match in the document.
+func (index *textIndex) search(query string) map[int]float64 {
+	var scores map[int]float64
+	for _, term := range searchTerms(query) {
+		termScores := make(map[int]float64)
+		for word, documents := range index.postings {
+			similarity := termSimilarity(term, word)
+			if similarity <= 0 {
+				continue
+			}
+			for document, weight := range documents {
+				if score := similarity * weight; score > termScores[document] {
+					termScores[document] = score
+				}
+			}
+		}
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+		for document := range scores {
+			if termScore, ok := termScores[document]; ok {
+				scores[document] += termScore
+			} else {
+				delete(scores, document)
+			}
+		}
+	}
+	return scores
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFoldText(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"Müller", "muller"},
+		{"Crème Brûlée", "creme brulee"},
+		{"Straße", "strasse"},
+		{"Smørrebrød", "smorrebrod"},
+		{"Łódź", "lodz"},
+	}
+	for _, test := range tests {
+		if got := foldText(test.s); got != test.want {
+			t.Errorf("foldText(%s) = %s, expected %s", test.s, got, test.want)
+		}
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	got := searchTerms("Hof Müller: Eier, Käse & 3-Korn-Brot")
+	want := []string{"hof", "muller", "eier", "kase", "3", "korn", "brot"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		max  int
+		want int
+	}{
+		{"honey", "honey", 2, 0},
+		{"honey", "money", 2, 1},
+		{"honey", "hony", 2, 1},
+		{"honey", "honeys", 2, 1},
+		// a transposition is a single typo
+		{"honey", "hoeny", 2, 1},
+		{"honey", "ohney", 2, 1},
+		{"honey", "hnoye", 2, 2},
+		// letters rather than bytes count
+		{"käse", "kase", 2, 1},
+		{"käse", "käse", 0, 0},
+		// beyond max, max+1 is returned
+		{"honey", "bread", 2, 3},
+		{"honey", "ho", 2, 3},
+		{"", "abc", 1, 2},
+	}
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b, test.max); got != test.want {
+			t.Errorf("editDistance(%s, %s, %d) = %d, expected %d", test.a, test.b, test.max, got, test.want)
+		}
+	}
+}
+
+func TestMaxTypos(t *testing.T) {
+	tests := []struct {
+		term string
+		want int
+	}{
+		{"egg", 0},
+		{"eier", 1},
+		{"äpfel", 1},
+		{"strawber", 2},
+		// 7 letters, but 8 bytes
+		{"gemüsen", 1},
+	}
+	for _, test := range tests {
+		if got := maxTypos(test.term); got != test.want {
+			t.Errorf("maxTypos(%s) = %d, expected %d", test.term, got, test.want)
+		}
+	}
+}
+
+func TestTermSimilarity(t *testing.T) {
+	tests := []struct {
+		term string
+		word string
+		want float64
+	}{
+		{"honey", "honey", 1},
+		{"hon", "honey", 0.8},
+		// too short for prefixes and typos
+		{"ho", "honey", 0},
+		{"egg", "ega", 0},
+		{"honey", "hony", 0.7},
+		{"strawbery", "strawberry", 0.7},
+		{"strwbery", "strawberry", 0.4},
+		{"honey", "bread", 0},
+	}
+	for _, test := range tests {
+		if got := termSimilarity(test.term, test.word); got < test.want-1e-9 || got > test.want+1e-9 {
+			t.Errorf("termSimilarity(%s, %s) = %g, expected %g", test.term, test.word, got, test.want)
+		}
+	}
+}
+
+func TestTextIndexSearch(t *testing.T) {
+	index := newTextIndex()
+	index.add(0, "Hof Müller", 3)
+	index.add(0, "Honey and eggs", 1)
+	index.add(1, "Imkerei Schulz", 3)
+	index.add(1, "Honey", 2)
+	index.add(2, "Bakery", 3)
+
+	tests := []struct {
+		query string
+		want  map[int]float64
+	}{
+		// the weight of the field counts
+		{"honey", map[int]float64{0: 1, 1: 2}},
+		// diacritics and typos are tolerated
+		{"muller", map[int]float64{0: 3}},
+		{"Mueller", map[int]float64{0: 3 * 0.7}},
+		{"Shulz", map[int]float64{1: 3 * 0.7}},
+		// all terms must match
+		{"honey muller", map[int]float64{0: 4}},
+		{"honey bakery", map[int]float64{}},
+		{"bak", map[int]float64{2: 3 * 0.8}},
+	}
+	for _, test := range tests {
+		got := index.search(test.query)
+		if len(got) != len(test.want) {
+			t.Errorf("search(%s) = %v, expected %v", test.query, got, test.want)
+			continue
+		}
+		for document, want := range test.want {
+			if score, ok := got[document]; !ok || score < want-1e-9 || score > want+1e-9 {
+				t.Errorf("search(%s) = %v, expected %v", test.query, got, test.want)
+				break
+			}
+		}
+	}
+}
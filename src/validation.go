@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	maxNameLength        = 100
+	maxTextLength        = 200
+	maxDescriptionLength = 2000
+	maxRating            = 5
+)
+
+// validPriceUnits are the units a price may be given per.
+var validPriceUnits = []string{"piece", "bunch", "dozen", "g", "kg", "ml", "l"}
+
+var (
+	countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+	zipCodePattern     = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z -]{0,9}$`)
+)
+
+// validationError lists every violation found in a request body. Each
+// violation names the offending field by its JSON path, e.g.
+// "location.latitude" or "[2].price.perUnit".
+type validationError struct {
+	violations []apiError
+}
+
+func (e validationError) Error() string {
+	messages := make([]string, 0, len(e.violations))
+	for _, violation := range e.violations {
+		messages = append(messages, violation.Field+": "+violation.Message)
+	}
+	return "Validation failed: " + strings.Join(messages, "; ")
+}
+
+// validator collects violations. With partial set, as for PATCH, fields that
+// are empty count as absent and only the present ones are checked. Grocery
+// types and features must be ids of the taxonomy.
+type validator struct {
+	partial    bool
+	taxonomy   *taxonomy
+	violations []apiError
+}
+
+func (v *validator) invalid(field string, format string, args ...interface{}) {
+	v.violations = append(v.violations, apiError{Code: errorCodeInvalidField, Message: fmt.Sprintf(format, args...), Field: field})
+}
+
+func (v *validator) missing(field string) {
+	v.violations = append(v.violations, apiError{Code: errorCodeMissingField, Message: "The field is required.", Field: field})
+}
+
+// err returns the violations as validationError, or nil if there are none.
+func (v *validator) err() error {
+	if len(v.violations) <= 0 {
+		return nil
+	}
+	return validationError{violations: v.violations}
+}
+
+// text checks a free text field that is required unless v is partial.
+func (v *validator) text(field string, value string, required bool, maxLength int) {
+	if len(value) <= 0 {
+		if required && !v.partial {
+			v.missing(field)
+		}
+		return
+	}
+	if len(strings.TrimSpace(value)) <= 0 {
+		v.invalid(field, "The field must not be blank.")
+	} else if utf8.RuneCountInString(value) > maxLength {
+		v.invalid(field, "The field must be at most %d characters long.", maxLength)
+	}
+}
+
+// tags checks a list of tags such as features.
+func (v *validator) tags(field string, values []string) {
+	for i, value := range values {
+		tagField := fmt.Sprintf("%s[%d]", field, i)
+		if len(strings.TrimSpace(value)) <= 0 {
+			v.invalid(tagField, "The value must not be blank.")
+		} else if slices.Index(values, value) < i {
+			v.invalid(tagField, "The value '%s' is listed more than once.", value)
+		}
+	}
+}
+
+// features checks that the features are in the feature catalogue.
+func (v *validator) features(field string, values []string) {
+	for i, value := range values {
+		if len(strings.TrimSpace(value)) > 0 && !v.taxonomy.isFeature(value) {
+			v.invalid(fmt.Sprintf("%s[%d]", field, i), "Unknown feature '%s', see /api/taxonomy/features.", value)
+		}
+	}
+}
+
+func (v *validator) groceryType(field string, value string) {
+	if len(value) > 0 && !v.taxonomy.isGroceryType(value) {
+		v.invalid(field, "Unknown grocery type '%s', see /api/taxonomy/groceryTypes.", value)
+	}
+}
+
+func (v *validator) imageUrl(field string, value string) {
+	if len(value) <= 0 {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) <= 0 {
+		v.invalid(field, "The field must be an http or https URL.")
+	}
+}
+
+func (v *validator) geoLocation(field string, location geoLocation) {
+	// zero is indistinguishable from absent, so a farmer on the equator or
+	// the prime meridian is fine as long as the other coordinate is set
+	if location == (geoLocation{}) {
+		if !v.partial {
+			v.missing(field)
+		}
+		return
+	}
+	if location.Longitude < -180 || location.Longitude > 180 {
+		v.invalid(field+".longitude", "The longitude must be between -180 and 180.")
+	}
+	if location.Latitude < -90 || location.Latitude > 90 {
+		v.invalid(field+".latitude", "The latitude must be between -90 and 90.")
+	}
+}
+
+func (v *validator) address(field string, address address) {
+	v.text(field+".street", address.Street, false, maxTextLength)
+	v.text(field+".city", address.City, false, maxTextLength)
+	if len(address.ZipCode) > 0 && !zipCodePattern.MatchString(address.ZipCode) {
+		v.invalid(field+".zipCode", "The zip code must be up to 10 letters, digits, spaces or hyphens.")
+	}
+	if len(address.Country) > 0 && !countryCodePattern.MatchString(address.Country) {
+		v.invalid(field+".country", "The country must be an ISO 3166-1 alpha-2 code such as 'DE'.")
+	}
+}
+
+// openingHours checks that the keys are weekdays and every range is a pair of
+// seconds from the start of the day. The end may lie before the start for
+// ranges crossing midnight. A range whose start equals its end could mean
+// closed or open all day, so it is rejected; a whole day is [0, 86400].
+func (v *validator) openingHours(field string, openingHours map[string][][]int32) {
+	days := make(map[string]string)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		days[openingHoursDayKey(day)] = ""
+	}
+	keys := maps.Keys(openingHours)
+	sort.Strings(keys)
+	for _, key := range keys {
+		ranges := openingHours[key]
+		dayField := field + "." + key
+		dayKey := strings.ToLower(key)
+		other, ok := days[dayKey]
+		if !ok {
+			v.invalid(dayField, "The key must be a day of the week such as 'monday'.")
+			continue
+		}
+		if len(other) > 0 {
+			v.invalid(dayField, "The day is also given as '%s'.", other)
+		}
+		days[dayKey] = key
+		for i, r := range ranges {
+			rangeField := fmt.Sprintf("%s[%d]", dayField, i)
+			if len(r) != 2 {
+				v.invalid(rangeField, "The range must consist of a start and an end.")
+				continue
+			}
+			if r[0] < 0 || r[0] >= secondsPerDay {
+				v.invalid(rangeField, "The start must be between 0 and %d seconds.", secondsPerDay-1)
+			}
+			if r[1] < 0 || r[1] > secondsPerDay {
+				v.invalid(rangeField, "The end must be between 0 and %d seconds.", secondsPerDay)
+			} else if r[1] == r[0] {
+				v.invalid(rangeField, "The end must differ from the start, a whole day is [0, %d].", secondsPerDay)
+			}
+		}
+	}
+}
+
+func (v *validator) price(field string, p price) {
+	if p == (price{}) {
+		if !v.partial {
+			v.missing(field)
+		}
+		return
+	}
+	if p.Value < 0 {
+		v.invalid(field+".value", "The price must not be negative.")
+	} else if p.Value == 0 && !v.partial {
+		v.missing(field + ".value")
+	}
+	if len(p.PerUnit) <= 0 {
+		if !v.partial {
+			v.missing(field + ".perUnit")
+		}
+	} else if !slices.Contains(validPriceUnits, p.PerUnit) {
+		v.invalid(field+".perUnit", "The unit must be one of '%s'.", strings.Join(validPriceUnits, "', '"))
+	}
+}
+
+func (v *validator) farmer(prefix string, farmer farmer) {
+	v.text(prefix+"name", farmer.Name, true, maxNameLength)
+	if farmer.Rating < 0 || farmer.Rating > maxRating {
+		v.invalid(prefix+"rating", "The rating must be between 0 and %d.", maxRating)
+	}
+	v.imageUrl(prefix+"titleImage", farmer.TitleImage)
+	v.address(prefix+"address", farmer.Address)
+	v.geoLocation(prefix+"location", farmer.Location)
+	v.tags(prefix+"features", farmer.Features)
+	v.features(prefix+"features", farmer.Features)
+	v.openingHours(prefix+"openingHoursByDayOfWeek_secondsFromStartOfDay", farmer.OpeningHoursByDayOfWeekSecondsFromStartOfDay)
+	if len(farmer.TimeZone) > 0 {
+		if _, err := time.LoadLocation(farmer.TimeZone); err != nil {
+			v.invalid(prefix+"timeZone", "The time zone must be an IANA time zone such as 'Europe/Berlin'.")
+		}
+	}
+}
+
+func (v *validator) product(prefix string, product product) {
+	v.text(prefix+"name", product.Name, true, maxNameLength)
+	v.text(prefix+"groceryType", product.GroceryType, true, maxNameLength)
+	v.groceryType(prefix+"groceryType", product.GroceryType)
+	v.text(prefix+"description", product.Description, false, maxDescriptionLength)
+	v.price(prefix+"price", product.Price)
+	v.imageUrl(prefix+"titleImage", product.TitleImage)
+}
+
+// validateFarmer checks a farmer to be created or replaced, or, if partial
+// is set, the changes to a farmer.
+func validateFarmer(taxonomy *taxonomy, farmer farmer, partial bool) error {
+	v := validator{partial: partial, taxonomy: taxonomy}
+	v.farmer("", farmer)
+	return v.err()
+}
+
+// validateProductChanges checks the changes to a product.
+func validateProductChanges(taxonomy *taxonomy, product product) error {
+	v := validator{partial: true, taxonomy: taxonomy}
+	v.product("", product)
+	return v.err()
+}
+
+// validateProducts checks products to be created, naming fields by their
+// index in the request body.
+func validateProducts(taxonomy *taxonomy, products []product) error {
+	v := validator{taxonomy: taxonomy}
+	if len(products) <= 0 {
+		v.invalid("", "At least one product is required.")
+	}
+	for i, product := range products {
+		v.product(fmt.Sprintf("[%d].", i), product)
+	}
+	return v.err()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// violationsOf maps the fields of the violations in err to their codes.
+func violationsOf(t *testing.T, err error) map[string]string {
+	t.Helper()
+	fields := make(map[string]string)
+	if err == nil {
+		return fields
+	}
+	var validationErr validationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a validationError, got %v", err)
+	}
+	for _, violation := range validationErr.violations {
+		fields[violation.Field] = violation.Code
+	}
+	return fields
+}
+
+// validFarmer returns a farmer that passes validation, to be broken by one
+// change per test case.
+func validFarmer() farmer {
+	return farmer{
+		Name:       "Hof Müller",
+		Rating:     4,
+		TitleImage: "https://example.com/hof.jpg",
+		Address:    address{Street: "Dorfstraße 1", City: "Berlin", ZipCode: "10115", Country: "DE"},
+		Location:   geoLocation{Longitude: 13.4, Latitude: 52.5},
+		Features:   []string{"farm-shop"},
+		OpeningHoursByDayOfWeekSecondsFromStartOfDay: map[string][][]int32{
+			"monday": {{8 * 3600, 18 * 3600}},
+		},
+		TimeZone: "Europe/Berlin",
+	}
+}
+
+func TestValidateFarmer(t *testing.T) {
+	taxonomy := mustNewTaxonomy(t)
+	tests := []struct {
+		name    string
+		change  func(farmer *farmer)
+		partial bool
+		field   string
+		code    string
+	}{
+		{"valid", func(f *farmer) {}, false, "", ""},
+		{"missing name", func(f *farmer) { f.Name = "" }, false, "name", errorCodeMissingField},
+		{"blank name", func(f *farmer) { f.Name = "  " }, false, "name", errorCodeInvalidField},
+		{"long name", func(f *farmer) { f.Name = strings.Repeat("ü", maxNameLength+1) }, false, "name", errorCodeInvalidField},
+		{"name of max length", func(f *farmer) { f.Name = strings.Repeat("ü", maxNameLength) }, false, "", ""},
+		{"negative rating", func(f *farmer) { f.Rating = -1 }, false, "rating", errorCodeInvalidField},
+		{"rating above max", func(f *farmer) { f.Rating = maxRating + 0.5 }, false, "rating", errorCodeInvalidField},
+		{"relative image", func(f *farmer) { f.TitleImage = "/hof.jpg" }, false, "titleImage", errorCodeInvalidField},
+		{"ftp image", func(f *farmer) { f.TitleImage = "ftp://example.com/hof.jpg" }, false, "titleImage", errorCodeInvalidField},
+		{"blank street", func(f *farmer) { f.Address.Street = " " }, false, "address.street", errorCodeInvalidField},
+		{"long city", func(f *farmer) { f.Address.City = strings.Repeat("a", maxTextLength+1) }, false, "address.city", errorCodeInvalidField},
+		{"invalid zip code", func(f *farmer) { f.Address.ZipCode = "10115 Berlin" }, false, "address.zipCode", errorCodeInvalidField},
+		{"lower case country", func(f *farmer) { f.Address.Country = "de" }, false, "address.country", errorCodeInvalidField},
+		{"missing location", func(f *farmer) { f.Location = geoLocation{} }, false, "location", errorCodeMissingField},
+		{"longitude out of range", func(f *farmer) { f.Location.Longitude = 180.5 }, false, "location.longitude", errorCodeInvalidField},
+		{"latitude out of range", func(f *farmer) { f.Location.Latitude = -90.5 }, false, "location.latitude", errorCodeInvalidField},
+		{"on the equator", func(f *farmer) { f.Location.Latitude = 0 }, false, "", ""},
+		{"blank feature", func(f *farmer) { f.Features = []string{"farm-shop", ""} }, false, "features[1]", errorCodeInvalidField},
+		{"duplicate feature", func(f *farmer) { f.Features = []string{"farm-shop", "farm-shop"} }, false, "features[1]", errorCodeInvalidField},
+		{"unknown feature", func(f *farmer) { f.Features = []string{"farm-shop", "unicorns"} }, false, "features[1]", errorCodeInvalidField},
+		{"feature label instead of id", func(f *farmer) { f.Features = []string{"Hofladen"} }, false, "features[0]", errorCodeInvalidField},
+		{"unknown day", func(f *farmer) {
+			f.OpeningHoursByDayOfWeekSecondsFromStartOfDay = map[string][][]int32{"funday": {{0, 3600}}}
+		}, false, "openingHoursByDayOfWeek_secondsFromStartOfDay.funday", errorCodeInvalidField},
+		{"day given twice", func(f *farmer) {
+			f.OpeningHoursByDayOfWeekSecondsFromStartOfDay = map[string][][]int32{"Monday": {{0, 3600}}, "monday": {{0, 3600}}}
+		}, false, "openingHoursByDayOfWeek_secondsFromStartOfDay.monday", errorCodeInvalidField},
+		{"range without end", func(f *farmer) {
+			f.OpeningHoursByDayOfWeekSecondsFromStartOfDay = map[string][][]int32{"monday": {{3600}}}
+		}, false, "openingHoursByDayOfWeek_secondsFromStartOfDay.monday[0]", errorCodeInvalidField},
+		{"start of next day", func(f *farmer) {
+			f.OpeningHoursByDayOfWeekSecondsFromStartOfDay = map[string][][]int32{"monday": {{secondsPerDay, 3600}}}
+		}, false, "openingHoursByDayOfWeek_secondsFromStartOfDay.monday[0]", errorCodeInvalidField},
+		{"end after the day", func(f *farmer) {
+			f.OpeningHoursByDayOfWeekSecondsFromStartOfDay = map[string][][]int32{"monday": {{3600, secondsPerDay + 1}}}
+		}, false, "openingHoursByDayOfWeek_secondsFromStartOfDay.monday[0]", errorCodeInvalidField},
+		{"start equals end", func(f *farmer) {
+			f.OpeningHoursByDayOfWeekSecondsFromStartOfDay = map[string][][]int32{"monday": {{3600, 3600}}}
+		}, false, "openingHoursByDayOfWeek_secondsFromStartOfDay.monday[0]", errorCodeInvalidField},
+		{"empty range at midnight", func(f *farmer) {
+			f.OpeningHoursByDayOfWeekSecondsFromStartOfDay = map[string][][]int32{"monday": {{0, 0}}}
+		}, false, "openingHoursByDayOfWeek_secondsFromStartOfDay.monday[0]", errorCodeInvalidField},
+		{"whole day", func(f *farmer) {
+			f.OpeningHoursByDayOfWeekSecondsFromStartOfDay = map[string][][]int32{"monday": {{0, secondsPerDay}}}
+		}, false, "", ""},
+		{"across midnight", func(f *farmer) {
+			f.OpeningHoursByDayOfWeekSecondsFromStartOfDay = map[string][][]int32{"friday": {{20 * 3600, 2 * 3600}}}
+		}, false, "", ""},
+		{"unknown time zone", func(f *farmer) { f.TimeZone = "Europe/Atlantis" }, false, "timeZone", errorCodeInvalidField},
+		{"partial without name and location", func(f *farmer) {
+			*f = farmer{Rating: 3}
+		}, true, "", ""},
+		{"partial with invalid latitude", func(f *farmer) {
+			*f = farmer{Location: geoLocation{Longitude: 13.4, Latitude: 91}}
+		}, true, "location.latitude", errorCodeInvalidField},
+	}
+	for _, test := range tests {
+		farmer := validFarmer()
+		test.change(&farmer)
+		fields := violationsOf(t, validateFarmer(taxonomy, farmer, test.partial))
+		if len(test.field) <= 0 {
+			if len(fields) > 0 {
+				t.Errorf("%s: expected no violations, got %v", test.name, fields)
+			}
+			continue
+		}
+		if len(fields) != 1 || fields[test.field] != test.code {
+			t.Errorf("%s: expected %s for %s, got %v", test.name, test.code, test.field, fields)
+		}
+	}
+}
+
+func TestValidateProducts(t *testing.T) {
+	taxonomy := mustNewTaxonomy(t)
+	valid := product{Name: "Ziegenkäse", GroceryType: "goat-cheese", Price: price{Value: 4.5, PerUnit: "piece"}}
+	tests := []struct {
+		name   string
+		change func(product *product)
+		field  string
+		code   string
+	}{
+		{"valid", func(p *product) {}, "", ""},
+		{"missing name", func(p *product) { p.Name = "" }, "[0].name", errorCodeMissingField},
+		{"missing grocery type", func(p *product) { p.GroceryType = "" }, "[0].groceryType", errorCodeMissingField},
+		{"unknown grocery type", func(p *product) { p.GroceryType = "caviar" }, "[0].groceryType", errorCodeInvalidField},
+		{"long description", func(p *product) { p.Description = strings.Repeat("a", maxDescriptionLength+1) }, "[0].description", errorCodeInvalidField},
+		{"missing price", func(p *product) { p.Price = price{} }, "[0].price", errorCodeMissingField},
+		{"missing price value", func(p *product) { p.Price.Value = 0 }, "[0].price.value", errorCodeMissingField},
+		{"negative price", func(p *product) { p.Price.Value = -1 }, "[0].price.value", errorCodeInvalidField},
+		{"missing unit", func(p *product) { p.Price.PerUnit = "" }, "[0].price.perUnit", errorCodeMissingField},
+		{"unknown unit", func(p *product) { p.Price.PerUnit = "crate" }, "[0].price.perUnit", errorCodeInvalidField},
+		{"invalid image", func(p *product) { p.TitleImage = "cheese.jpg" }, "[0].titleImage", errorCodeInvalidField},
+	}
+	for _, test := range tests {
+		changed := valid
+		test.change(&changed)
+		fields := violationsOf(t, validateProducts(taxonomy, []product{changed}))
+		if len(test.field) <= 0 {
+			if len(fields) > 0 {
+				t.Errorf("%s: expected no violations, got %v", test.name, fields)
+			}
+			continue
+		}
+		if len(fields) != 1 || fields[test.field] != test.code {
+			t.Errorf("%s: expected %s for %s, got %v", test.name, test.code, test.field, fields)
+		}
+	}
+
+	if fields := violationsOf(t, validateProducts(taxonomy, nil)); fields[""] != errorCodeInvalidField {
+		t.Errorf("Expected an empty list to be rejected, got %v", fields)
+	}
+	// changes only check the fields they set
+	if fields := violationsOf(t, validateProductChanges(taxonomy, product{Price: price{Value: 2}})); len(fields) > 0 {
+		t.Errorf("Expected a price change to pass, got %v", fields)
+	}
+	if fields := violationsOf(t, validateProductChanges(taxonomy, product{Price: price{PerUnit: "crate"}})); fields["price.perUnit"] != errorCodeInvalidField {
+		t.Errorf("Expected an unknown unit to be rejected, got %v", fields)
+	}
+}